@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"kamaji/obj"
+	"kamaji/rt"
+	"kamaji/target"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// affectedTargets returns the targets affected by the changes since base, or by
+// the files listed on stdin when fromStdin is set. Listed files are relative to
+// the workspace root. base is also used to find out which third parties of the
+// workspace file changed; without it a change to that file affects every target.
+func affectedTargets(buildFileName string, base string, fromStdin bool, tags []string) ([]obj.ExecTarget, error) {
+	var changedFiles []string
+	var err error
+	if fromStdin {
+		changedFiles, err = readChangedFiles(os.Stdin, rt.Config.WorkspaceDir)
+	} else if base != "" {
+		changedFiles, err = gitChangedFiles(base)
+	} else {
+		return nil, fmt.Errorf("either --base or a file list on stdin (-) is required")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var oldWorkspaceFile []byte
+	if base != "" {
+		oldWorkspaceFile, err = gitShow(base, obj.WorkspaceFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	affected, err := target.AffectedTargets(changedFiles, buildFileName, oldWorkspaceFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var selected []obj.ExecTarget
+	for _, t := range affected {
+		if target.HasTags(t, tags) {
+			selected = append(selected, t)
+		}
+	}
+	return selected, nil
+}
+
+// printAffected prints the labels of the targets, either one per line or as JSON.
+func printAffected(targets []obj.ExecTarget, output string) error {
+	labels := make([]string, 0, len(targets))
+	for _, t := range targets {
+		labels = append(labels, t.Label)
+	}
+
+	switch output {
+	case "json":
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(labels)
+	case "text":
+		for _, l := range labels {
+			fmt.Println(l)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported output format: %s", output)
+	}
+}
+
+// readChangedFiles reads one path per line, resolving relative paths against dir.
+func readChangedFiles(r io.Reader, dir string) ([]string, error) {
+	var files []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if !filepath.IsAbs(line) {
+			line = filepath.Join(dir, line)
+		}
+		files = append(files, filepath.Clean(line))
+	}
+	return files, scanner.Err()
+}
+
+// gitChangedFiles lists the files that differ between the merge base of base and
+// HEAD and the working tree, so uncommitted and untracked changes count as well.
+// Renamed files are listed under both names.
+func gitChangedFiles(base string) ([]string, error) {
+	// git lists paths relative to the top level of the repository, which may be
+	// above the workspace root
+	prefix, err := git("rev-parse", "--show-prefix")
+	if err != nil {
+		return nil, err
+	}
+
+	mergeBase, err := git("merge-base", base, "HEAD")
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := git("diff", "--name-only", "--no-renames", strings.TrimSpace(string(mergeBase)))
+	if err != nil {
+		return nil, err
+	}
+
+	untracked, err := git("ls-files", "--others", "--exclude-standard", "--full-name", ":/")
+	if err != nil {
+		return nil, err
+	}
+	out = append(out, untracked...)
+
+	var workspaceFiles bytes.Buffer
+	for _, line := range strings.Split(string(out), "\n") {
+		if file, ok := strings.CutPrefix(line, strings.TrimSpace(string(prefix))); ok && file != "" {
+			fmt.Fprintln(&workspaceFiles, file)
+		}
+	}
+	return readChangedFiles(&workspaceFiles, rt.Config.WorkspaceDir)
+}
+
+// gitShow returns the content of a file of the workspace at the merge base of
+// base and HEAD, or an empty document when it did not exist yet.
+func gitShow(base string, file string) ([]byte, error) {
+	mergeBase, err := git("merge-base", base, "HEAD")
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := git("show", strings.TrimSpace(string(mergeBase))+":./"+file)
+	if err != nil {
+		return []byte{}, nil
+	}
+	return content, nil
+}
+
+func git(args ...string) ([]byte, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = rt.Config.WorkspaceDir
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git %s: %s: %s", strings.Join(args, " "), err.Error(), strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"kamaji/execroot"
+	"kamaji/rt"
+	"kamaji/runner"
+	"kamaji/target"
+	"kamaji/tools"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"gopkg.in/yaml.v2"
+)
+
+type thirdPartyDescription struct {
+	Name    string   `json:"name"`
+	Version string   `json:"version,omitempty"`
+	URLs    []string `json:"urls"`
+	SHA256  string   `json:"sha256"`
+	Cache   string   `json:"cache"`
+	Path    string   `json:"path"`
+}
+
+type settingDescription struct {
+	Value  string `json:"value"`
+	Origin string `json:"origin"`
+}
+
+type targetDescription struct {
+	Name        string                        `json:"name"`
+	Rule        string                        `json:"rule"`
+	RulePath    string                        `json:"rule_path"`
+	WorkingDir  string                        `json:"working_dir"`
+	Config      map[string]any                `json:"config"`
+	Origins     map[string]string             `json:"origins,omitempty"`
+	ThirdParty  []thirdPartyDescription       `json:"third_party"`
+	Environment []string                      `json:"environment"`
+	Settings    map[string]settingDescription `json:"settings"`
+	Argv        []string                      `json:"argv"`
+	Problems    string                        `json:"problems,omitempty"`
+}
+
+// describeTarget prints everything Kamaji would do to run the target without
+// creating an execroot or running the rule. Validation problems are printed as
+// part of the description, and valid reports whether there were none.
+func describeTarget(buildFileName string, targetName string, output string, pythonArgs []string) (valid bool, err error) {
+	execTarget, err := target.ResolveTarget(targetName, buildFileName)
+	if err != nil {
+		return false, err
+	}
+
+	validationErr := target.ValidateTargetVariables(&execTarget)
+
+	description := targetDescription{
+		Name:        execTarget.Name,
+		Rule:        execTarget.Rule,
+		RulePath:    filepath.Join(rt.Config.WorkspaceConfig.RulesDir, execTarget.Rule),
+		WorkingDir:  execTarget.Dir,
+		Config:      tools.NormalizeValue(execTarget.Config).(map[string]any),
+		Origins:     execTarget.Origins,
+		ThirdParty:  []thirdPartyDescription{},
+		Environment: runner.Environment(rt.Config.WorkspaceConfig),
+		Settings:    make(map[string]settingDescription),
+	}
+	for _, name := range rt.SettingNames() {
+		origin := rt.Config.Origins[name]
+		if origin == "" {
+			origin = "default"
+		}
+		description.Settings[name] = settingDescription{Value: rt.SettingValue(name), Origin: origin}
+	}
+	if rt.Config.Isolated {
+		description.WorkingDir = filepath.Join("<execroot>", "origin")
+	}
+	if validationErr != nil {
+		description.Problems = validationErr.Error()
+	}
+
+	finalPaths := make(map[string]string)
+	for _, name := range target.ThirdPartyReferences(execTarget) {
+		thirdParty, err := target.FindThirdPartyConfig(rt.Config.WorkspaceConfig, name)
+		if err != nil {
+			return false, err
+		}
+
+		sha256 := thirdParty.SHA256s[rt.Config.Platform]
+		tfi := target.FileInfo(thirdParty)
+		path, err := execroot.ThirdPartyPath(tfi)
+		if err != nil {
+			// not extracted yet, show where the file will be
+			relPath := tfi.FinalName
+			if len(tfi.Executable) > 0 {
+				relPath = tfi.Executable[0]
+			}
+			path = filepath.Join(tfi.FileName, "__TMP__", tfi.StripPrefix, relPath)
+		}
+		finalPaths[name] = path
+
+		description.ThirdParty = append(description.ThirdParty, thirdPartyDescription{
+			Name:    thirdParty.Name,
+			Version: thirdParty.Version,
+			URLs:    redactURLs(target.DownloadURLs(thirdParty)),
+			SHA256:  sha256,
+			Cache:   target.CacheStatus(thirdParty),
+			Path:    path,
+		})
+	}
+
+	pythonExecutable, err := runner.PythonInterpreter()
+	if err != nil {
+		pythonExecutable = "python"
+	}
+	argv, err := runner.PrepareCmdline(pythonExecutable, execTarget, finalPaths)
+	if err != nil {
+		return false, err
+	}
+	description.Argv = append(argv, pythonArgs...)
+
+	switch output {
+	case "json":
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(description); err != nil {
+			return false, err
+		}
+	case "text":
+		printDescription(description)
+	default:
+		return false, fmt.Errorf("unsupported output format: %s", output)
+	}
+
+	return validationErr == nil, nil
+}
+
+func printDescription(d targetDescription) {
+	fmt.Printf("Target:      %s\n", d.Name)
+	fmt.Printf("Rule:        %s\n", d.Rule)
+	fmt.Printf("Rule path:   %s\n", d.RulePath)
+	fmt.Printf("Working dir: %s\n", d.WorkingDir)
+
+	fmt.Printf("\nConfig:\n")
+	configYAML, err := yaml.Marshal(d.Config)
+	if err == nil {
+		for _, line := range strings.Split(strings.TrimRight(string(configYAML), "\n"), "\n") {
+			fmt.Printf("  %s\n", line)
+		}
+	}
+
+	if len(d.Origins) > 0 {
+		fmt.Printf("\nOrigins:\n")
+		fields := make([]string, 0, len(d.Origins))
+		for field := range d.Origins {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		for _, field := range fields {
+			fmt.Fprintf(w, "  %s\t%s\n", field, d.Origins[field])
+		}
+		w.Flush()
+	}
+
+	if len(d.ThirdParty) > 0 {
+		fmt.Printf("\nThird party:\n")
+		for _, tp := range d.ThirdParty {
+			fmt.Printf("  @@%s\n", tp.Name)
+			if tp.Version != "" {
+				fmt.Printf("    version: %s\n", tp.Version)
+			}
+			for _, url := range tp.URLs {
+				fmt.Printf("    url:     %s\n", url)
+			}
+			fmt.Printf("    sha256:  %s\n", tp.SHA256)
+			fmt.Printf("    cache:   %s\n", tp.Cache)
+			fmt.Printf("    path:    %s\n", tp.Path)
+		}
+	}
+
+	fmt.Printf("\nEnvironment:\n")
+	for _, env := range d.Environment {
+		fmt.Printf("  %s\n", env)
+	}
+
+	fmt.Printf("\nSettings:\n")
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, name := range rt.SettingNames() {
+		setting := d.Settings[name]
+		fmt.Fprintf(w, "  %s\t%s\t%s\n", name, setting.Value, setting.Origin)
+	}
+	w.Flush()
+
+	fmt.Printf("\nCommand:\n  %s\n", tools.ShellQuote(d.Argv))
+
+	if d.Problems != "" {
+		fmt.Printf("\nProblems:\n")
+		for _, line := range strings.Split(d.Problems, "\n") {
+			fmt.Printf("  %s\n", line)
+		}
+	}
+}
+
+func redactURLs(urls []string) []string {
+	redacted := make([]string, len(urls))
+	for i, url := range urls {
+		redacted[i] = target.RedactURL(url)
+	}
+	return redacted
+}
@@ -0,0 +1,293 @@
+package execroot
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"kamaji/obj"
+	"kamaji/rt"
+	"kamaji/tools"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// archiveHandler extracts the downloaded file src of a third party into dest.
+type archiveHandler func(src string, dest string, tfi obj.ThirdPartyFileInfo) error
+
+// decompressor wraps a reader of compressed data.
+type decompressor func(r io.Reader) (io.ReadCloser, error)
+
+// decompressors are keyed by the extension of the compression. Every one of them
+// adds a tar.<ext> archive type for compressed tarballs and an <ext> archive type
+// for a single compressed binary.
+var decompressors = map[string]decompressor{
+	"gz": func(r io.Reader) (io.ReadCloser, error) { return gzip.NewReader(r) },
+	"bz2": func(r io.Reader) (io.ReadCloser, error) {
+		return io.NopCloser(bzip2.NewReader(r)), nil
+	},
+	"xz": func(r io.Reader) (io.ReadCloser, error) {
+		xzr, err := xz.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(xzr), nil
+	},
+	"zst": func(r io.Reader) (io.ReadCloser, error) {
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	},
+}
+
+// compressionTypes maps the detected MIME type of compressed files to their
+// decompressor.
+var compressionTypes = map[string]string{
+	"application/gzip":    "gz",
+	"application/x-bzip2": "bz2",
+	"application/x-xz":    "xz",
+	"application/zstd":    "zst",
+}
+
+// archiveHandlers holds a handler for every archive type, which is either
+// detected from the downloaded file or set with archive_type.
+var archiveHandlers = map[string]archiveHandler{
+	"zip":    extractZip,
+	"tar":    tarHandler(""),
+	"binary": binaryHandler(""),
+}
+
+func init() {
+	for compression := range decompressors {
+		archiveHandlers["tar."+compression] = tarHandler(compression)
+		archiveHandlers[compression] = binaryHandler(compression)
+	}
+}
+
+// ArchiveTypes returns the archive types that can be set with archive_type,
+// sorted.
+func ArchiveTypes() []string {
+	types := make([]string, 0, len(archiveHandlers))
+	for archiveType := range archiveHandlers {
+		types = append(types, archiveType)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// extractArchive extracts the downloaded file of tfi into its __TMP__ directory.
+// The archive type set in the config wins over the one detected from fileType,
+// the MIME type recorded in the metadata file.
+func extractArchive(tfi obj.ThirdPartyFileInfo, fileType string) error {
+	tmpDir := filepath.Join(tfi.FileName, "__TMP__")
+	if err := os.MkdirAll(tmpDir, os.ModePerm); err != nil {
+		return fmt.Errorf("failed to create __TMP__ directory: %s", err.Error())
+	}
+
+	sourceFile := filepath.Join(tfi.FileName, "file")
+	archiveType := tfi.ArchiveType
+	if archiveType == "" {
+		var err error
+		if archiveType, err = detectArchiveType(sourceFile, fileType); err != nil {
+			return err
+		}
+	}
+
+	handler, ok := archiveHandlers[archiveType]
+	if !ok {
+		return fmt.Errorf("unknown archive_type '%s', expected one of %s", archiveType, strings.Join(ArchiveTypes(), ", "))
+	}
+	if rt.Config.DebugMode {
+		log.Printf("Extracting %s as %s into %s\n", sourceFile, archiveType, tmpDir)
+	}
+	if err := handler(sourceFile, tmpDir, tfi); err != nil {
+		return fmt.Errorf("failed to extract %s file: %s", archiveType, err.Error())
+	}
+	return nil
+}
+
+// detectArchiveType maps the MIME type of the downloaded file to an archive
+// type. Compressed files are tarballs when the decompressed data starts with a
+// tar header, and a single compressed binary otherwise.
+func detectArchiveType(src string, fileType string) (string, error) {
+	switch fileType {
+	case "application/zip":
+		return "zip", nil
+	case "application/x-tar":
+		return "tar", nil
+	case "application/x-executable", "application/x-mach-binary":
+		return "binary", nil
+	}
+
+	compression, ok := compressionTypes[fileType]
+	if !ok {
+		if fileType == "" {
+			fileType = "unknown"
+		}
+		return "", fmt.Errorf("unsupported file type: %s, set archive_type to one of %s", fileType, strings.Join(ArchiveTypes(), ", "))
+	}
+
+	r, err := openDecompressed(src, compression)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	// a tar header is 512 bytes and has the ustar magic at offset 257
+	header := make([]byte, 512)
+	n, err := io.ReadFull(r, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", fmt.Errorf("failed to decompress %s file: %s", compression, err.Error())
+	}
+	if n == len(header) && bytes.HasPrefix(header[257:], []byte("ustar")) {
+		return "tar." + compression, nil
+	}
+	return compression, nil
+}
+
+// decompressedFile closes both the decompressor and the file it reads.
+type decompressedFile struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (d *decompressedFile) Close() error {
+	var err error
+	for _, c := range d.closers {
+		if closeErr := c.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// openDecompressed opens src, decompressing it unless compression is empty.
+func openDecompressed(src string, compression string) (io.ReadCloser, error) {
+	file, err := os.Open(src)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %s", err.Error())
+	}
+	if compression == "" {
+		return file, nil
+	}
+
+	r, err := decompressors[compression](file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to create %s reader: %s", compression, err.Error())
+	}
+	return &decompressedFile{Reader: r, closers: []io.Closer{r, file}}, nil
+}
+
+func extractZip(src string, dest string, tfi obj.ThirdPartyFileInfo) error {
+	return tools.Unzip(src, dest)
+}
+
+// binaryHandler returns a handler for a single executable, such as an ELF or
+// Mach-O binary, optionally compressed. The binary is written to the file_path
+// of the third party and made executable.
+func binaryHandler(compression string) archiveHandler {
+	return func(src string, dest string, tfi obj.ThirdPartyFileInfo) error {
+		r, err := openDecompressed(src, compression)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+
+		destFile := filepath.Join(dest, tfi.FinalName)
+		if err := os.MkdirAll(filepath.Dir(destFile), os.ModePerm); err != nil {
+			return fmt.Errorf("failed to create directory: %s", err.Error())
+		}
+		out, err := os.OpenFile(destFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
+		if err != nil {
+			return fmt.Errorf("failed to create file: %s", err.Error())
+		}
+		defer out.Close()
+
+		if _, err := io.Copy(out, r); err != nil {
+			return fmt.Errorf("failed to copy binary: %s", err.Error())
+		}
+		return out.Close()
+	}
+}
+
+// tarHandler returns a handler for tarballs, optionally compressed.
+func tarHandler(compression string) archiveHandler {
+	return func(src string, dest string, tfi obj.ThirdPartyFileInfo) error {
+		r, err := openDecompressed(src, compression)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+
+		return extractTar(r, dest)
+	}
+}
+
+// extractTar extracts the files, directories and symlinks of a tarball into
+// dest, keeping the permissions of files so executables stay executable.
+func extractTar(r io.Reader, dest string) error {
+	tarReader := tar.NewReader(r)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break // End of archive
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read tar header: %s", err.Error())
+		}
+
+		target := filepath.Join(dest, header.Name)
+		relPath, err := filepath.Rel(dest, target)
+		if err != nil || strings.HasPrefix(relPath, "..") {
+			return fmt.Errorf("illegal file path: %s", header.Name)
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, os.ModePerm); err != nil {
+				return fmt.Errorf("failed to create directory: %s", err.Error())
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), os.ModePerm); err != nil {
+				return fmt.Errorf("failed to create directory: %s", err.Error())
+			}
+			outFile, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, header.FileInfo().Mode().Perm())
+			if err != nil {
+				return fmt.Errorf("failed to create file: %s", err.Error())
+			}
+			if _, err := io.Copy(outFile, tarReader); err != nil {
+				outFile.Close()
+				return fmt.Errorf("failed to copy file: %s", err.Error())
+			}
+			outFile.Close()
+		case tar.TypeSymlink:
+			linkPath, err := filepath.Rel(dest, filepath.Join(filepath.Dir(target), header.Linkname))
+			if filepath.IsAbs(header.Linkname) || err != nil || strings.HasPrefix(linkPath, "..") {
+				return fmt.Errorf("illegal symlink: %s -> %s", header.Name, header.Linkname)
+			}
+			if err := os.MkdirAll(filepath.Dir(target), os.ModePerm); err != nil {
+				return fmt.Errorf("failed to create directory: %s", err.Error())
+			}
+			if err := os.Symlink(header.Linkname, target); err != nil {
+				return fmt.Errorf("failed to create symlink: %s", err.Error())
+			}
+		case tar.TypeXGlobalHeader:
+			// pax metadata of the whole archive, nothing to extract
+		default:
+			return fmt.Errorf("unsupported file type: %c", header.Typeflag)
+		}
+	}
+
+	return nil
+}
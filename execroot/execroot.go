@@ -1,10 +1,9 @@
 package execroot
 
 import (
-	"archive/tar"
-	"compress/gzip"
 	"fmt"
 	"io"
+	"io/fs"
 	"kamaji/obj"
 	"kamaji/rt"
 	"kamaji/tools"
@@ -12,6 +11,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 )
 
 func parseMetadata(metadata string) (string, string) {
@@ -19,172 +19,194 @@ func parseMetadata(metadata string) (string, string) {
 	return parts[1], parts[0]
 }
 
-func handleMacBinaryFile(tfi obj.ThirdPartyFileInfo) error {
-	tmpDir := filepath.Join(tfi.FileName, "__TMP__")
-	if err := os.MkdirAll(tmpDir, os.ModePerm); err != nil {
-		return fmt.Errorf("failed to create __TMP__ directory: %s", err.Error())
+// CreateExecRootDir creates a fresh execroot for the target of run and records
+// it in run.ExecRootDir.
+func CreateExecRootDir(run *obj.TargetRun) error {
+	execRootDir := fmt.Sprintf(
+		"%s/execroot/%s-%s",
+		rt.Config.TmpDir,
+		run.Target.Name,
+		tools.RandStringRunes(6),
+	)
+	if rt.Config.DebugMode {
+		log.Printf("Creating execroot dir: %s\n", execRootDir)
 	}
 
-	sourceFile := filepath.Join(tfi.FileName, "file")
-	destFile := filepath.Join(tmpDir, filepath.Base(tfi.FinalName))
-	if err := tools.CopyFile(sourceFile, destFile); err != nil {
-		return fmt.Errorf("failed to copy Mach-O binary: %s", err.Error())
+	if err := os.MkdirAll(execRootDir, 0700); err != nil {
+		return fmt.Errorf("failed to create execroot dir: %s", err.Error())
 	}
 
-	if err := os.Chmod(destFile, 0700); err != nil {
-		return fmt.Errorf("failed to make Mach-O binary executable: %s", err.Error())
-	}
+	run.ExecRootDir = execRootDir
 
 	return nil
 }
 
-func handleZipFile(tfi obj.ThirdPartyFileInfo, fileName string) error {
-	tmpDir := filepath.Join(tfi.FileName, "__TMP__")
-	if err := os.MkdirAll(tmpDir, os.ModePerm); err != nil {
-		return fmt.Errorf("failed to create __TMP__ directory: %s", err.Error())
-	}
-
-	destFile := filepath.Join(tmpDir, fmt.Sprintf("%s.zip", fileName))
-	sourceFile := filepath.Join(tfi.FileName, "file")
-	if err := tools.CopyFile(sourceFile, destFile); err != nil {
-		return fmt.Errorf("failed to copy file: %s", err.Error())
+// extractLocks serializes the extraction of each cache entry, which is shared by
+// every target using the same third party.
+var extractLocks sync.Map
+
+// extractThirdParty unpacks a cached third party into its __TMP__ directory once
+// and returns the path of its file. A marker file records a complete
+// extraction, so the files are not rewritten while another target may be
+// executing them.
+func extractThirdParty(tfi obj.ThirdPartyFileInfo) (string, error) {
+	lock, _ := extractLocks.LoadOrStore(tfi.FileName, &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	defer lock.(*sync.Mutex).Unlock()
+
+	metadataFilePath := filepath.Join(tfi.FileName, "metadata")
+	metadataContent, err := os.ReadFile(metadataFilePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read metadata file: %s", err.Error())
 	}
 
-	return tools.Unzip(destFile, tmpDir)
-}
+	metadata := string(metadataContent)
+	fileType, _ := parseMetadata(metadata)
 
-func handleTarGzFile(tfi obj.ThirdPartyFileInfo) error {
-	tmpDir := filepath.Join(tfi.FileName, "__TMP__")
-	if err := os.MkdirAll(tmpDir, os.ModePerm); err != nil {
-		return fmt.Errorf("failed to create __TMP__ directory: %s", err.Error())
-	}
-
-	sourceFile := filepath.Join(tfi.FileName, "file")
-	if err := extractTarGz(sourceFile, tmpDir); err != nil {
-		return fmt.Errorf("failed to extract tar.gz file: %s", err.Error())
-	}
-
-	targetFilePath := filepath.Join(tmpDir, "darwin-arm64", filepath.Base(tfi.FinalName))
-	if err := os.Chmod(targetFilePath, 0755); err != nil {
-		return fmt.Errorf("failed to make file executable: %s", err.Error())
+	// the marker holds the archive_type the files were extracted with, so
+	// changing it extracts them again
+	marker := filepath.Join(tfi.FileName, "__TMP__", ".extracted")
+	if extractedAs, err := os.ReadFile(marker); err != nil || string(extractedAs) != tfi.ArchiveType {
+		if err := os.RemoveAll(filepath.Join(tfi.FileName, "__TMP__")); err != nil {
+			return "", fmt.Errorf("failed to clean __TMP__ directory: %s", err.Error())
+		}
+		if err := extractArchive(tfi, fileType); err != nil {
+			return "", err
+		}
+		if err := os.WriteFile(marker, []byte(tfi.ArchiveType), 0644); err != nil {
+			return "", fmt.Errorf("failed to write extraction marker: %s", err.Error())
+		}
 	}
 
-	return nil
-}
-
-func handleFileType(fileType string, tfi obj.ThirdPartyFileInfo, fileName string) error {
-	switch fileType {
-	case "application/zip":
-		return handleZipFile(tfi, fileName)
-	case "application/x-mach-binary":
-		return handleMacBinaryFile(tfi)
-	case "application/gzip":
-		return handleTarGzFile(tfi)
-	default:
-		return fmt.Errorf("unsupported file type: %s", fileType)
+	// executable can change without extracting again
+	if err := makeExecutable(tfi); err != nil {
+		return "", err
 	}
+	return ThirdPartyPath(tfi)
 }
 
-func extractTarGz(src, dest string) error {
-	file, err := os.Open(src)
-	if err != nil {
-		return fmt.Errorf("failed to open tar.gz file: %s", err.Error())
+// ThirdPartyPath returns the path of the file of a third party in its __TMP__
+// directory: the first match of its executable globs or, without them, its
+// file_path, both relative to strip_prefix.
+func ThirdPartyPath(tfi obj.ThirdPartyFileInfo) (string, error) {
+	root := filepath.Join(tfi.FileName, "__TMP__", tfi.StripPrefix)
+	if len(tfi.Executable) > 0 {
+		for _, pattern := range tfi.Executable {
+			matches, err := filepath.Glob(filepath.Join(root, pattern))
+			if err != nil {
+				return "", fmt.Errorf("invalid executable pattern '%s': %s", pattern, err.Error())
+			}
+			for _, match := range matches {
+				if info, err := os.Stat(match); err == nil && info.Mode().IsRegular() {
+					return match, nil
+				}
+			}
+		}
+		return "", fmt.Errorf("no file matches executable %s in %s%s", strings.Join(tfi.Executable, ", "), root, candidatesHint(tfi))
 	}
-	defer file.Close()
 
-	gzr, err := gzip.NewReader(file)
-	if err != nil {
-		return fmt.Errorf("failed to create gzip reader: %s", err.Error())
+	path := filepath.Join(root, tfi.FinalName)
+	if _, err := os.Stat(path); err != nil {
+		return "", fmt.Errorf("%s not found in %s%s", tfi.FinalName, root, candidatesHint(tfi))
 	}
-	defer gzr.Close()
-
-	tarReader := tar.NewReader(gzr)
+	return path, nil
+}
 
-	for {
-		header, err := tarReader.Next()
-		if err == io.EOF {
-			break // End of archive
-		}
+// makeExecutable sets the executable bits of the files matching the executable
+// globs of a third party.
+func makeExecutable(tfi obj.ThirdPartyFileInfo) error {
+	root := filepath.Join(tfi.FileName, "__TMP__", tfi.StripPrefix)
+	for _, pattern := range tfi.Executable {
+		matches, err := filepath.Glob(filepath.Join(root, pattern))
 		if err != nil {
-			return fmt.Errorf("failed to read tar header: %s", err.Error())
+			return fmt.Errorf("invalid executable pattern '%s': %s", pattern, err.Error())
 		}
-
-		target := filepath.Join(dest, header.Name)
-		switch header.Typeflag {
-		case tar.TypeDir:
-			if err := os.MkdirAll(target, os.ModePerm); err != nil {
-				return fmt.Errorf("failed to create directory: %s", err.Error())
-			}
-		case tar.TypeReg:
-			outFile, err := os.Create(target)
-			if err != nil {
-				return fmt.Errorf("failed to create file: %s", err.Error())
+		for _, match := range matches {
+			info, err := os.Stat(match)
+			if err != nil || !info.Mode().IsRegular() {
+				continue
 			}
-			if _, err := io.Copy(outFile, tarReader); err != nil {
-				outFile.Close()
-				return fmt.Errorf("failed to copy file: %s", err.Error())
+			if err := os.Chmod(match, info.Mode().Perm()|0111); err != nil {
+				return fmt.Errorf("failed to make %s executable: %s", match, err.Error())
 			}
-			outFile.Close()
-		default:
-			return fmt.Errorf("unsupported file type: %c", header.Typeflag)
 		}
 	}
-
 	return nil
 }
 
-func CreateExecRootDir(target obj.ExecTarget) error {
-	execRootDir := fmt.Sprintf(
-		"%s/execroot/%s-%s",
-		rt.Config.TmpDir,
-		target.Name,
-		tools.RandStringRunes(6),
-	)
-	if rt.Config.DebugMode {
-		log.Printf("Creating execroot dir: %s\n", execRootDir)
-	}
-
-	if err := os.MkdirAll(execRootDir, 0700); err != nil {
-		return fmt.Errorf("failed to create execroot dir: %s", err.Error())
+// candidatesHint lists the files of the extracted archive named like the file of
+// the third party, to help setting strip_prefix or executable.
+func candidatesHint(tfi obj.ThirdPartyFileInfo) string {
+	tmpDir := filepath.Join(tfi.FileName, "__TMP__")
+	var candidates []string
+	filepath.WalkDir(tmpDir, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() && d.Name() == filepath.Base(tfi.FinalName) {
+			relPath, _ := filepath.Rel(tmpDir, path)
+			candidates = append(candidates, relPath)
+		}
+		return nil
+	})
+	if len(candidates) == 0 {
+		return ""
 	}
-
-	rt.Config.ExecRootDir = execRootDir
-
-	return nil
+	return fmt.Sprintf(", set strip_prefix or executable to use one of: %s", strings.Join(candidates, ", "))
 }
 
-func CopyThirdPartyIntoExecRootDir() error {
-	for fileName, tfi := range rt.Config.ThirdPartyFiles {
-		metadataFilePath := filepath.Join(tfi.FileName, "metadata")
-		metadataContent, err := os.ReadFile(metadataFilePath)
+// CopyThirdPartyIntoExecRootDir links every third party of run into the
+// external directory of its execroot and records the final paths of the files.
+func CopyThirdPartyIntoExecRootDir(run *obj.TargetRun) error {
+	for fileName, tfi := range run.ThirdPartyFiles {
+		targetFullPath, err := extractThirdParty(tfi)
 		if err != nil {
-			return fmt.Errorf("failed to read metadata file: %s", err.Error())
-		}
-
-		metadata := string(metadataContent)
-		fileType, targetFileName := parseMetadata(metadata)
-		if err := handleFileType(fileType, tfi, fileName); err != nil {
-			return err
+			return fmt.Errorf("%s: %s", fileName, err.Error())
 		}
 
 		// create external dir in execroot
-		externalDir := filepath.Join(rt.Config.ExecRootDir, "external")
+		externalDir := filepath.Join(run.ExecRootDir, "external")
 		if err := os.MkdirAll(externalDir, 0700); err != nil {
 			return fmt.Errorf("failed to create external dir: %s", err.Error())
 		}
 
-		thirdPartyFileInExecRootDir := filepath.Join(rt.Config.ExecRootDir, "external", tfi.FinalName)
-		targetFullPath := tools.GetFullPath(filepath.Join(tfi.FileName, "__TMP__"), targetFileName)
-		if targetFullPath == "" {
-			return fmt.Errorf("target file not found in %s", filepath.Join(tfi.FileName, "__TMP__"))
-		}
-
+		thirdPartyFileInExecRootDir := filepath.Join(run.ExecRootDir, "external", tfi.FinalName)
 		if err := os.Symlink(targetFullPath, thirdPartyFileInExecRootDir); err != nil {
 			return fmt.Errorf("failed to create softlink: %s", err.Error())
 		}
 
-		rt.Config.ThirdPartyFinalPaths[fileName] = targetFullPath
+		run.ThirdPartyFinalPaths[fileName] = targetFullPath
 	}
 
 	return nil
 }
+
+// PrintLayout writes the tree of the execroot dir to w, showing where each
+// symlink points to.
+func PrintLayout(w io.Writer, execRootDir string) error {
+	return filepath.WalkDir(execRootDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == execRootDir {
+			return nil
+		}
+
+		relPath, err := filepath.Rel(execRootDir, path)
+		if err != nil {
+			return err
+		}
+		indent := strings.Repeat("  ", strings.Count(relPath, string(filepath.Separator))+1)
+
+		switch {
+		case d.Type()&fs.ModeSymlink != 0:
+			linkTarget, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(w, "%s%s -> %s\n", indent, d.Name(), linkTarget)
+		case d.IsDir():
+			fmt.Fprintf(w, "%s%s/\n", indent, d.Name())
+		default:
+			fmt.Fprintf(w, "%s%s\n", indent, d.Name())
+		}
+		return nil
+	})
+}
@@ -4,7 +4,9 @@ go 1.24
 
 require (
 	github.com/h2non/filetype v1.1.3
+	github.com/klauspost/compress v1.18.0
 	github.com/spf13/pflag v1.0.6
+	github.com/ulikunitz/xz v0.5.15
 	golang.org/x/exp v0.0.0-20250128182459-e0ece0dbea4c
 	gopkg.in/yaml.v2 v2.4.0
 )
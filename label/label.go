@@ -0,0 +1,133 @@
+package label
+
+import (
+	"fmt"
+	"kamaji/rt"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Label addresses a target in the workspace. Package is the directory of its
+// build file relative to the workspace root, using forward slashes, and is empty
+// for the root itself.
+type Label struct {
+	Package string
+	Name    string
+}
+
+func (l Label) String() string {
+	return "//" + l.Package + ":" + l.Name
+}
+
+// IsLabel reports whether s is written as a label rather than as a bare target name.
+func IsLabel(s string) bool {
+	return strings.HasPrefix(s, "//") || strings.Contains(s, ":")
+}
+
+// Parse parses a label. "//pkg:name" is relative to the workspace root, while
+// ":name", "name" and "dir:name" are relative to the package pkg.
+func Parse(s string, pkg string) (Label, error) {
+	var l Label
+	switch {
+	case strings.HasPrefix(s, "//"):
+		p, name, found := strings.Cut(s[2:], ":")
+		if !found {
+			return l, fmt.Errorf("label %q has no target name", s)
+		}
+		l = Label{Package: p, Name: name}
+	case strings.Contains(s, ":"):
+		dir, name, _ := strings.Cut(s, ":")
+		l = Label{Package: path.Join(pkg, dir), Name: name}
+	default:
+		l = Label{Package: pkg, Name: s}
+	}
+
+	l.Package = path.Clean(l.Package)
+	if l.Package == ".." || strings.HasPrefix(l.Package, "../") || strings.HasPrefix(l.Package, "/") {
+		return l, fmt.Errorf("label %q points outside of the workspace", s)
+	}
+	if l.Package == "." {
+		l.Package = ""
+	}
+	if l.Name == "" || strings.ContainsAny(l.Name, "/:") {
+		return l, fmt.Errorf("label %q has an invalid target name", s)
+	}
+
+	return l, nil
+}
+
+// PackageOf returns the package of dir, which must be inside the workspace.
+func PackageOf(dir string) (string, error) {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+
+	relDir, err := filepath.Rel(rt.Config.WorkspaceDir, absDir)
+	if err != nil || relDir == ".." || strings.HasPrefix(relDir, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is outside of the workspace %s", dir, rt.Config.WorkspaceDir)
+	}
+	if relDir == "." {
+		return "", nil
+	}
+	return filepath.ToSlash(relDir), nil
+}
+
+// BuildFile returns the path of the build file that defines the target of l.
+func BuildFile(l Label, buildFileName string) string {
+	return filepath.Join(rt.Config.WorkspaceDir, filepath.FromSlash(l.Package), buildFileName)
+}
+
+// Pattern selects several targets at once. Recursive patterns match every
+// package below Package as well, and the name "all" matches every target.
+type Pattern struct {
+	Package   string
+	Recursive bool
+	Name      string
+}
+
+// IsPattern reports whether s selects several targets, as in "//infra/...",
+// "//infra/...:staging" or "//infra:all".
+func IsPattern(s string) bool {
+	pkg, name, _ := strings.Cut(s, ":")
+	return pkg == "//..." || pkg == "..." || strings.HasSuffix(pkg, "/...") || name == "all"
+}
+
+// ParsePattern parses a target pattern relative to the package pkg. A recursive
+// pattern without a target name selects all targets.
+func ParsePattern(s string, pkg string) (Pattern, error) {
+	pkgPart, name, found := strings.Cut(s, ":")
+	if !found {
+		name = "all"
+	}
+
+	var p Pattern
+	switch {
+	case pkgPart == "//...":
+		p.Recursive, pkgPart = true, "//"
+	case pkgPart == "...":
+		p.Recursive, pkgPart = true, ""
+	case strings.HasSuffix(pkgPart, "/..."):
+		p.Recursive, pkgPart = true, strings.TrimSuffix(pkgPart, "/...")
+	}
+
+	l, err := Parse(pkgPart+":"+name, pkg)
+	if err != nil {
+		return p, fmt.Errorf("invalid pattern %q: %s", s, err.Error())
+	}
+	p.Package, p.Name = l.Package, l.Name
+
+	return p, nil
+}
+
+// Matches reports whether the pattern selects a target of the package pkg named name.
+func (p Pattern) Matches(pkg string, name string) bool {
+	if p.Name != "all" && p.Name != name {
+		return false
+	}
+	if p.Recursive {
+		return p.Package == "" || pkg == p.Package || strings.HasPrefix(pkg, p.Package+"/")
+	}
+	return pkg == p.Package
+}
@@ -0,0 +1,133 @@
+package label
+
+import (
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name  string
+		label string
+		pkg   string
+		want  Label
+	}{
+		{name: "absolute", label: "//infra/dns:plan", pkg: "apps", want: Label{Package: "infra/dns", Name: "plan"}},
+		{name: "absolute root", label: "//:plan", pkg: "apps", want: Label{Package: "", Name: "plan"}},
+		{name: "bare name", label: "plan", pkg: "apps", want: Label{Package: "apps", Name: "plan"}},
+		{name: "colon name", label: ":plan", pkg: "apps", want: Label{Package: "apps", Name: "plan"}},
+		{name: "bare name in the root", label: "plan", pkg: "", want: Label{Package: "", Name: "plan"}},
+		{name: "relative package", label: "dns:plan", pkg: "infra", want: Label{Package: "infra/dns", Name: "plan"}},
+		{name: "parent package", label: "../db:plan", pkg: "infra/dns", want: Label{Package: "infra/db", Name: "plan"}},
+		{name: "cleaned package", label: "//infra/./dns/:plan", pkg: "", want: Label{Package: "infra/dns", Name: "plan"}},
+		{name: "back to the root", label: "..:plan", pkg: "infra", want: Label{Package: "", Name: "plan"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse(tt.label, tt.pkg)
+			if err != nil {
+				t.Fatalf("Parse(%q, %q) error = %v", tt.label, tt.pkg, err)
+			}
+			if got != tt.want {
+				t.Errorf("Parse(%q, %q) = %#v, want %#v", tt.label, tt.pkg, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		label string
+		pkg   string
+		want  string
+	}{
+		{name: "no target name", label: "//infra", pkg: "", want: `label "//infra" has no target name`},
+		{name: "empty name", label: "//infra:", pkg: "", want: `label "//infra:" has an invalid target name`},
+		{name: "slash in name", label: "infra/plan", pkg: "", want: `label "infra/plan" has an invalid target name`},
+		{name: "second colon", label: "//infra:a:b", pkg: "", want: `label "//infra:a:b" has an invalid target name`},
+		{name: "above the workspace", label: "../x:plan", pkg: "", want: `label "../x:plan" points outside of the workspace`},
+		{name: "absolute above the workspace", label: "//../x:plan", pkg: "", want: `label "//../x:plan" points outside of the workspace`},
+		{name: "relative above the workspace", label: "../../x:plan", pkg: "infra", want: `label "../../x:plan" points outside of the workspace`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse(tt.label, tt.pkg)
+			if err == nil {
+				t.Fatalf("Parse(%q, %q) error = nil, want %q", tt.label, tt.pkg, tt.want)
+			}
+			if err.Error() != tt.want {
+				t.Errorf("Parse(%q, %q) error = %q, want %q", tt.label, tt.pkg, err.Error(), tt.want)
+			}
+		})
+	}
+}
+
+func TestParsePattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		pkg     string
+		want    Pattern
+	}{
+		{pattern: "//...", pkg: "apps", want: Pattern{Package: "", Recursive: true, Name: "all"}},
+		{pattern: "...", pkg: "apps", want: Pattern{Package: "apps", Recursive: true, Name: "all"}},
+		{pattern: "//infra/...", pkg: "", want: Pattern{Package: "infra", Recursive: true, Name: "all"}},
+		{pattern: "//infra/...:staging", pkg: "", want: Pattern{Package: "infra", Recursive: true, Name: "staging"}},
+		{pattern: "dns/...", pkg: "infra", want: Pattern{Package: "infra/dns", Recursive: true, Name: "all"}},
+		{pattern: "//infra:all", pkg: "", want: Pattern{Package: "infra", Name: "all"}},
+		{pattern: ":all", pkg: "infra", want: Pattern{Package: "infra", Name: "all"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.pattern, func(t *testing.T) {
+			if !IsPattern(tt.pattern) {
+				t.Errorf("IsPattern(%q) = false, want true", tt.pattern)
+			}
+			got, err := ParsePattern(tt.pattern, tt.pkg)
+			if err != nil {
+				t.Fatalf("ParsePattern(%q, %q) error = %v", tt.pattern, tt.pkg, err)
+			}
+			if got != tt.want {
+				t.Errorf("ParsePattern(%q, %q) = %#v, want %#v", tt.pattern, tt.pkg, got, tt.want)
+			}
+		})
+	}
+
+	for _, s := range []string{"//infra:plan", "plan", ":plan", "//infra"} {
+		if IsPattern(s) {
+			t.Errorf("IsPattern(%q) = true, want false", s)
+		}
+	}
+
+	if _, err := ParsePattern("//../...", ""); err == nil {
+		t.Errorf("ParsePattern(%q) error = nil, want a pattern outside of the workspace to fail", "//../...")
+	}
+}
+
+func TestPatternMatches(t *testing.T) {
+	tests := []struct {
+		name    string
+		pattern Pattern
+		pkg     string
+		target  string
+		want    bool
+	}{
+		{name: "everything", pattern: Pattern{Recursive: true, Name: "all"}, pkg: "infra/dns", target: "plan", want: true},
+		{name: "subpackage", pattern: Pattern{Package: "infra", Recursive: true, Name: "all"}, pkg: "infra/dns", target: "plan", want: true},
+		{name: "package itself", pattern: Pattern{Package: "infra", Recursive: true, Name: "all"}, pkg: "infra", target: "plan", want: true},
+		{name: "sibling with a common prefix", pattern: Pattern{Package: "infra", Recursive: true, Name: "all"}, pkg: "infrastructure", target: "plan", want: false},
+		{name: "named target", pattern: Pattern{Package: "infra", Recursive: true, Name: "staging"}, pkg: "infra/dns", target: "staging", want: true},
+		{name: "other target", pattern: Pattern{Package: "infra", Recursive: true, Name: "staging"}, pkg: "infra/dns", target: "prod", want: false},
+		{name: "not recursive", pattern: Pattern{Package: "infra", Name: "all"}, pkg: "infra/dns", target: "plan", want: false},
+		{name: "not recursive, same package", pattern: Pattern{Package: "infra", Name: "all"}, pkg: "infra", target: "plan", want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.pattern.Matches(tt.pkg, tt.target); got != tt.want {
+				t.Errorf("%#v.Matches(%q, %q) = %v, want %v", tt.pattern, tt.pkg, tt.target, got, tt.want)
+			}
+		})
+	}
+}
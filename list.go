@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"kamaji/target"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+type listedTarget struct {
+	Label       string   `json:"label"`
+	Name        string   `json:"name"`
+	Rule        string   `json:"rule"`
+	Description string   `json:"description,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+}
+
+// listTargets prints every target of the build file, either as a table or as JSON.
+func listTargets(buildFileName string, output string) error {
+	buildFile, err := target.LoadBuildFile(buildFileName)
+	if err != nil {
+		return err
+	}
+
+	targets := make([]listedTarget, 0, len(buildFile.Targets))
+	for _, t := range buildFile.Targets {
+		targets = append(targets, listedTarget{
+			Label:       t.Label,
+			Name:        t.Name,
+			Rule:        t.Rule,
+			Description: t.Description,
+			Tags:        t.Tags,
+		})
+	}
+
+	switch output {
+	case "json":
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(targets)
+	case "text":
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tRULE\tTAGS\tDESCRIPTION")
+		for _, t := range targets {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", t.Name, t.Rule, strings.Join(t.Tags, ","), t.Description)
+		}
+		return w.Flush()
+	default:
+		return fmt.Errorf("unsupported output format: %s", output)
+	}
+}
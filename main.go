@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"kamaji/obj"
 	"kamaji/rt"
@@ -8,8 +10,11 @@ import (
 	"kamaji/target"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/spf13/pflag"
 )
@@ -23,14 +28,28 @@ func main() {
 	cleanupFlag := pflag.BoolP("cleanup", "c", false, "cleanup mode")
 	isolatedFlag := pflag.BoolP("isolated", "i", false, "isolated mode")
 	pythonInterpreterFlag := pflag.StringP("python", "p", "", "Path to python interpreter")
+	dryRunFlag := pflag.Bool("dry-run", false, "prepare the execroot and print the command without running the rule")
+	keepExecRootFlag := pflag.Bool("keep-execroot", false, "do not remove the execroot directory after the run")
+	timeoutFlag := pflag.Duration("timeout", 0, "cancel the rule once it runs longer than this, overriding the timeout of the target")
+	gracePeriodFlag := pflag.Duration("grace-period", 10*time.Second, "time to wait after forwarding a signal to the rule before killing it")
+	tagsFlag := pflag.StringSlice("tag", nil, "only run targets selected by patterns that carry this tag (repeatable)")
+	jobsFlag := pflag.IntP("jobs", "j", 1, "number of independent targets to run in parallel")
+	baseFlag := pflag.String("base", "", "git ref the affected command compares the working tree with")
+	runFlag := pflag.Bool("run", false, "run the affected targets instead of printing them")
+	configFlag := pflag.StringArray("config", nil, "apply a named profile of the workspace file (repeatable)")
+	setFlag := pflag.StringArray("set", nil, "override a config key of every target that uses it, as key=value (repeatable)")
+	outputFlag := pflag.StringP("output", "o", "text", "output format of the list, describe and affected commands (text or json)")
 
 	pflag.Parse()
 
 	rt.Config.PythonInterpreter = *pythonInterpreterFlag
-
-	if *isolatedFlag {
-		rt.Config.Isolated = true
-	}
+	rt.Config.DryRun = *dryRunFlag
+	rt.Config.KeepExecRoot = *keepExecRootFlag
+	rt.Config.GracePeriod = *gracePeriodFlag
+	rt.Config.Timeout = *timeoutFlag
+	rt.Config.Jobs = *jobsFlag
+	rt.Config.Isolated = *isolatedFlag
+	rt.Config.DebugMode = *debugModeFlag
 
 	if *cleanupFlag {
 		for _, dirName := range []string{"cache", "execroot"} {
@@ -42,19 +61,29 @@ func main() {
 		os.Exit(0)
 	}
 
-	if *debugModeFlag {
-		rt.Config.DebugMode = true
-	} else {
-		rt.Config.DebugMode = false
+	layers, err := rt.ConfigLayers()
+	if err != nil {
+		log.Fatalf("Error reading config: %s\n", err.Error())
 	}
-
-	targetName := strings.TrimSpace(pflag.Arg(0))
-	if targetName == "" {
-		fmt.Printf("Target name is required\n")
-		os.Exit(1)
+	profiles, err := rt.ProfileLayers(*configFlag)
+	if err != nil {
+		log.Fatalf("Error reading config: %s\n", err.Error())
 	}
-	if rt.Config.DebugMode {
-		log.Printf("Target name is %s\n", targetName)
+	layers = append(layers, profiles...)
+	commandLine, err := commandLineOverrides(*setFlag)
+	if err != nil {
+		log.Fatalf("Error reading command line: %s\n", err.Error())
+	}
+	layers = append(layers, obj.ConfigLayer{Origin: "command line", Overrides: commandLine})
+	if err := rt.ApplyLayers(layers); err != nil {
+		log.Fatalf("Error applying config: %s\n", err.Error())
+	}
+
+	if pflag.Arg(0) == "list" {
+		if err := listTargets(*buildFileName, *outputFlag); err != nil {
+			log.Fatalf("Error listing targets: %s\n", err.Error())
+		}
+		os.Exit(0)
 	}
 
 	var restOfTheArgs []string
@@ -65,32 +94,132 @@ func main() {
 		}
 	}
 
-	execTarget, err := target.ParseBuildFile(*buildFileName, targetName)
-	if err != nil {
-		log.Fatalf("Error parsing build file: %s\n", err.Error())
+	if pflag.Arg(0) == "describe" {
+		describedTarget := strings.TrimSpace(pflag.Arg(1))
+		if describedTarget == "" {
+			fmt.Printf("Target name is required\n")
+			os.Exit(1)
+		}
+		valid, err := describeTarget(*buildFileName, describedTarget, *outputFlag, restOfTheArgs)
+		if err != nil {
+			log.Fatalf("Error describing target: %s\n", err.Error())
+		}
+		if !valid {
+			os.Exit(1)
+		}
+		os.Exit(0)
 	}
 
-	if execTarget.Name == "" {
-		log.Fatalf("Target not found in build file\n")
+	if pflag.Arg(0) == "affected" {
+		affected, err := affectedTargets(*buildFileName, *baseFlag, pflag.Arg(1) == "-", *tagsFlag)
+		if err != nil {
+			log.Fatalf("Error finding affected targets: %s\n", err.Error())
+		}
+		if !*runFlag {
+			if err := printAffected(affected, *outputFlag); err != nil {
+				log.Fatalf("Error printing affected targets: %s\n", err.Error())
+			}
+			os.Exit(0)
+		}
+		if len(affected) == 0 {
+			fmt.Printf("No targets affected\n")
+			os.Exit(0)
+		}
+		runTargets(affected, restOfTheArgs)
+		return
 	}
 
-	rt.Config.ExecTarget = execTarget
+	targetNames := pflag.Args()
+	if n := pflag.CommandLine.ArgsLenAtDash(); n >= 0 {
+		targetNames = targetNames[:n]
+	}
+	if len(targetNames) == 0 && len(*tagsFlag) > 0 {
+		targetNames = []string{"//..."}
+	}
+	if len(targetNames) == 0 {
+		fmt.Printf("Target name is required\n")
+		os.Exit(1)
+	}
+	if rt.Config.DebugMode {
+		log.Printf("Target names are %s\n", strings.Join(targetNames, ", "))
+	}
 
-	err = target.InitThirdPartyUsedInTarget(rt.Config.WorkspaceConfig, execTarget)
+	roots, err := resolveTargets(targetNames, *buildFileName, *tagsFlag)
 	if err != nil {
-		log.Fatalf("Error initializing third party used in target: %s\n", err.Error())
+		log.Fatalf("%s\n", err.Error())
 	}
 
-	err = runner.Run(rt.Config.WorkspaceConfig, execTarget, restOfTheArgs...)
+	runTargets(roots, restOfTheArgs)
+}
+
+// runTargets runs roots together with their dependencies and exits with the
+// status of the run when it fails.
+func runTargets(roots []obj.ExecTarget, pythonArgs []string) {
+	graph, err := target.BuildGraph(roots)
 	if err != nil {
-		log.Fatalf("Error running target: %s\n", err.Error())
+		log.Fatalf("Error resolving dependencies: %s\n", err.Error())
 	}
 
-	if rt.Config.DebugMode {
-		log.Printf("Cleaning up execroot directory: %s\n", rt.Config.ExecRootDir)
+	var validationErrs []error
+	for _, key := range graph.Order {
+		execTarget := graph.Targets[key]
+		if err := target.ValidateTargetVariables(&execTarget); err != nil {
+			validationErrs = append(validationErrs, err)
+		}
+		graph.Targets[key] = execTarget
 	}
-	err = os.RemoveAll(rt.Config.ExecRootDir)
+	if len(validationErrs) > 0 {
+		log.Fatalf("Error validating targets: %s\n", errors.Join(validationErrs...).Error())
+	}
+
+	ctx, stop := signalContext()
+	err = runGraph(ctx, graph, pythonArgs)
+	stop()
+
 	if err != nil {
-		log.Fatalf("Error removing execroot directory: %s\n", err.Error())
+		os.Exit(exitCode(err))
+	}
+}
+
+// commandLineOverrides turns the flags given on the command line into the last
+// config layer: flags of runtime settings, such as --python or --jobs, and
+// --set key=value config overrides.
+func commandLineOverrides(set []string) (obj.Overrides, error) {
+	overrides := obj.Overrides{Settings: make(map[string]string), Config: make(map[string]any)}
+	for _, name := range rt.SettingNames() {
+		flag := pflag.Lookup(strings.ReplaceAll(name, "_", "-"))
+		if flag != nil && flag.Changed {
+			overrides.Settings[name] = flag.Value.String()
+		}
+	}
+
+	for _, assignment := range set {
+		key, value, found := strings.Cut(assignment, "=")
+		if !found || key == "" {
+			return overrides, fmt.Errorf("invalid --set %q, expected key=value", assignment)
+		}
+		overrides.Config[key] = obj.RawOverride(value)
+	}
+	return overrides, nil
+}
+
+// signalContext returns a context that is cancelled with a runner.InterruptedError
+// when Kamaji receives SIGINT or SIGTERM, so the signal can be forwarded to the rule.
+func signalContext() (context.Context, func()) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		select {
+		case sig := <-signals:
+			cancel(&runner.InterruptedError{Signal: sig.(syscall.Signal)})
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx, func() {
+		signal.Stop(signals)
+		cancel(nil)
 	}
 }
@@ -1,55 +1,266 @@
 package obj
 
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// RuntimeConfig is the process wide configuration. It is shared by targets
+// running concurrently, so state of a single target belongs in TargetRun.
 type RuntimeConfig struct {
-	WorkspaceConfig      WorkspaceConfig
-	ExecTarget           ExecTarget
-	DebugMode            bool
-	WorkspaceRoot        string
-	WorkspaceDir         string
-	CacheDir             string
-	Platform             string
-	TmpDir               string
-	Isolated             bool
+	WorkspaceConfig   WorkspaceConfig
+	DebugMode         bool
+	WorkspaceRoot     string
+	WorkspaceDir      string
+	CacheDir          string
+	Platform          string
+	TmpDir            string
+	Isolated          bool
+	DryRun            bool
+	KeepExecRoot      bool
+	GracePeriod       time.Duration
+	Timeout           time.Duration
+	Jobs              int
+	RuleFile          string
+	PythonInterpreter string
+	Layers            []ConfigLayer
+	Origins           map[string]string
+}
+
+// ConfigLayer is one source of overrides: the workspace file, the local
+// workspace file, the user config, the environment or the command line. Layers
+// apply in that order, so later ones win.
+type ConfigLayer struct {
+	Origin    string
+	Overrides Overrides
+}
+
+// Overrides change runtime settings, such as python or jobs, the config of
+// targets, and the mirrors and the authentication, by host, of third party
+// downloads. Config applies to every target whose config or rule has the key;
+// Targets applies to the targets matched by a label or pattern.
+type Overrides struct {
+	Settings map[string]string         `yaml:"settings"`
+	Config   map[string]any            `yaml:"config"`
+	Targets  map[string]map[string]any `yaml:"targets"`
+	Mirrors  []Mirror                  `yaml:"mirrors"`
+	Auth     map[string]DownloadAuth   `yaml:"download_auth"`
+}
+
+// RawOverride is a config value set as a string with --set or in the
+// environment. It is converted to the type the rule declares for its key when
+// the override is applied, so "1.10" stays a string for a string variable.
+type RawOverride string
+
+// TargetRun holds the state of a single target while it runs.
+type TargetRun struct {
+	Target               ExecTarget
 	ExecRootDir          string
 	ThirdPartyFiles      map[string]ThirdPartyFileInfo
 	ThirdPartyFinalPaths map[string]string
-	RuleFile             string
-	PythonInterpreter    string
+	Stdin                io.Reader
+	Stdout               io.Writer
+	Stderr               io.Writer
 }
 
 type WorkspaceConfig struct {
-	WorkspaceRoot  string             `yaml:"workspace_root"`
-	RulesDir       string             `yaml:"rules_directory"`
-	RulesCommonDir string             `yaml:"rules_common_directory"`
-	WorkspaceVars  []WorkspaceVar     `yaml:"workspace_vars"`
-	ThirdParty     []ThirdPartyConfig `yaml:"third_party"`
+	WorkspaceRoot  string               `yaml:"workspace_root"`
+	RulesDir       string               `yaml:"rules_directory"`
+	RulesCommonDir string               `yaml:"rules_common_directory"`
+	WorkspaceVars  WorkspaceVars        `yaml:"workspace_vars"`
+	ThirdParty     []ThirdPartyConfig   `yaml:"third_party"`
+	StrictConfig   bool                 `yaml:"strict_config"`
+	Profiles       map[string]Overrides `yaml:"profiles"`
+	Overrides      `yaml:",inline"`
 }
 
-type WorkspaceVar struct {
-	Org_Domain string `yaml:"org_domain"`
-	Base_Dir   string `yaml:"base_dir"`
+// WorkspaceVars are the variables shared by every target, by name. They are
+// written as a mapping; the older list of mappings is still accepted, with
+// later entries overriding earlier ones.
+type WorkspaceVars map[string]string
+
+func (w *WorkspaceVars) UnmarshalYAML(unmarshal func(any) error) error {
+	var vars map[string]any
+	if err := unmarshal(&vars); err != nil {
+		var list []map[string]any
+		if listErr := unmarshal(&list); listErr != nil {
+			return err
+		}
+		vars = make(map[string]any)
+		for _, entry := range list {
+			for name, value := range entry {
+				vars[name] = value
+			}
+		}
+	}
+
+	*w = make(WorkspaceVars, len(vars))
+	for name, value := range vars {
+		switch value.(type) {
+		case map[any]any, []any:
+			return fmt.Errorf("workspace variable %s must be a plain value", name)
+		case nil:
+			(*w)[name] = ""
+		default:
+			(*w)[name] = fmt.Sprint(value)
+		}
+	}
+	return nil
 }
 
 type ThirdPartyFileInfo struct {
-	FileName  string
-	FinalName string
+	FileName    string
+	FinalName   string
+	ArchiveType string
+	StripPrefix string
+	Executable  []string
 }
 
 type ThirdPartyConfig struct {
-	Name     string            `yaml:"name"`
-	FilePath string            `yaml:"file_path"`
-	URLs     map[string]string `yaml:"url"`
-	SHA256s  map[string]string `yaml:"sha256"`
+	Name     string             `yaml:"name"`
+	Version  string             `yaml:"version"`
+	FilePath string             `yaml:"file_path"`
+	URLs     map[string]URLList `yaml:"url"`
+	SHA256s  map[string]string  `yaml:"sha256"`
+	Auth     *DownloadAuth      `yaml:"auth"`
+	// ArchiveType overrides the type detected from the downloaded file.
+	ArchiveType string `yaml:"archive_type"`
+	// StripPrefix is the directory of the archive holding the files, and
+	// Executable the globs, relative to it, of the files to make executable.
+	// The first match of Executable is the file of the third party.
+	StripPrefix PlatformString `yaml:"strip_prefix"`
+	Executable  []string       `yaml:"executable"`
+}
+
+// DownloadAuth describes how a download authenticates. The config only says
+// where credentials come from: Netrc looks the host up in ~/.netrc, BearerTokenEnv
+// names the environment variable holding a token, and header values can refer
+// to environment variables with ${env.NAME}.
+type DownloadAuth struct {
+	Netrc          bool              `yaml:"netrc"`
+	BearerTokenEnv string            `yaml:"bearer_token_env"`
+	Headers        map[string]string `yaml:"headers"`
+}
+
+// URLList is a list of URLs tried in order. A single URL can be written as a
+// plain string.
+type URLList []string
+
+func (u *URLList) UnmarshalYAML(unmarshal func(any) error) error {
+	var single string
+	if err := unmarshal(&single); err == nil {
+		*u = URLList{single}
+		return nil
+	}
+
+	var list []string
+	if err := unmarshal(&list); err != nil {
+		return err
+	}
+	*u = list
+	return nil
 }
 
+// PlatformString is a value that can differ per platform, keyed like the URLs
+// of a third party. A plain string applies to every platform.
+type PlatformString map[string]string
+
+func (p *PlatformString) UnmarshalYAML(unmarshal func(any) error) error {
+	var single string
+	if err := unmarshal(&single); err == nil {
+		*p = PlatformString{"": single}
+		return nil
+	}
+
+	var perPlatform map[string]string
+	if err := unmarshal(&perPlatform); err != nil {
+		return err
+	}
+	*p = perPlatform
+	return nil
+}
+
+// For returns the value of the platform, or the value of every platform.
+func (p PlatformString) For(platform string) string {
+	if value, ok := p[platform]; ok {
+		return value
+	}
+	return p[""]
+}
+
+// Mirror rewrites the download URLs that start with URLPrefix to start with
+// each of RewriteTo instead. With KeepOriginal the original URL is tried last.
+type Mirror struct {
+	URLPrefix    string  `yaml:"url_prefix"`
+	RewriteTo    URLList `yaml:"rewrite_to"`
+	KeepOriginal bool    `yaml:"keep_original"`
+}
+
+// ExecTarget is a target of a build file. BuildFile, Dir and Label are not part
+// of the file; they are filled in when the build file is loaded. Dir is the
+// directory of the build file and the one the rule runs in. Origins records
+// where the fields merged from defaults and templates came from.
 type ExecTarget struct {
-	Name   string         `yaml:"name"`
-	Rule   string         `yaml:"rule"`
-	Config map[string]any `yaml:"config"`
+	Name        string            `yaml:"name"`
+	Extends     string            `yaml:"extends"`
+	Rule        string            `yaml:"rule"`
+	Description string            `yaml:"description"`
+	Timeout     string            `yaml:"timeout"`
+	Tags        []string          `yaml:"tags"`
+	Deps        []string          `yaml:"deps"`
+	Config      map[string]any    `yaml:"config"`
+	BuildFile   string            `yaml:"-"`
+	Dir         string            `yaml:"-"`
+	Label       string            `yaml:"-"`
+	Origins     map[string]string `yaml:"-"`
+}
+
+// RuleDefinition mirrors the rule_definition.yaml file that lives next to a rule.
+// When Strict is set, config keys that are not declared in Variables are rejected.
+type RuleDefinition struct {
+	Language  string                  `yaml:"language"`
+	Strict    bool                    `yaml:"strict"`
+	Variables map[string]VariableSpec `yaml:"variables"`
+}
+
+// VariableSpec describes a single variable a rule accepts. It can be written
+// either as a mapping with a "type" key or, as a shorthand, as the bare type name.
+//
+// Items describes the elements of a "list" or the values of a "map", Properties
+// describes the fields of an "object", Values lists the allowed values of an
+// "enum" and Pattern is the regular expression a "pattern" (or "string") must match.
+type VariableSpec struct {
+	Type        string                  `yaml:"type"`
+	Description string                  `yaml:"description"`
+	Mandatory   bool                    `yaml:"mandatory"`
+	Default     any                     `yaml:"default"`
+	Values      []any                   `yaml:"values"`
+	Pattern     string                  `yaml:"pattern"`
+	Items       *VariableSpec           `yaml:"items"`
+	Properties  map[string]VariableSpec `yaml:"properties"`
+}
+
+func (v *VariableSpec) UnmarshalYAML(unmarshal func(any) error) error {
+	var typeName string
+	if err := unmarshal(&typeName); err == nil {
+		v.Type = typeName
+		return nil
+	}
+
+	type plain VariableSpec
+	return unmarshal((*plain)(v))
 }
 
+// BuildFile is a build file or a fragment it includes. Defaults and Templates
+// have the shape of a target; fragments must not define Targets. Fragments lists
+// the paths of every fragment included, directly or not, once the file is loaded.
 type BuildFile struct {
-	Targets []ExecTarget `yaml:"targets"`
+	Include   []string     `yaml:"include"`
+	Defaults  ExecTarget   `yaml:"defaults"`
+	Templates []ExecTarget `yaml:"templates"`
+	Targets   []ExecTarget `yaml:"targets"`
+	Fragments []string     `yaml:"-"`
 }
 
 var WorkspaceFile string
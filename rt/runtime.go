@@ -56,8 +56,6 @@ func detectWorkspaceRoot() error {
 }
 
 func Init() {
-	Config.ThirdPartyFiles = make(map[string]obj.ThirdPartyFileInfo)
-	Config.ThirdPartyFinalPaths = make(map[string]string)
 	err := detectWorkspaceRoot()
 	if err != nil {
 		fmt.Printf("Error detecting workspace root: %v\n", err)
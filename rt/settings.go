@@ -0,0 +1,198 @@
+package rt
+
+import (
+	"errors"
+	"fmt"
+	"kamaji/obj"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// LocalWorkspaceFile overrides the workspace file on a single machine and is
+// meant to be ignored by git.
+const LocalWorkspaceFile = "kamaji.workspace.local.yaml"
+
+// setting is a runtime setting that can be overridden by every config layer.
+type setting struct {
+	get func() string
+	set func(value string) error
+}
+
+var settings = map[string]setting{
+	"python":        {func() string { return Config.PythonInterpreter }, func(v string) error { Config.PythonInterpreter = v; return nil }},
+	"isolated":      boolSetting(&Config.Isolated),
+	"debug":         boolSetting(&Config.DebugMode),
+	"keep_execroot": boolSetting(&Config.KeepExecRoot),
+	"jobs":          intSetting(&Config.Jobs),
+	"timeout":       durationSetting(&Config.Timeout),
+	"grace_period":  durationSetting(&Config.GracePeriod),
+}
+
+func boolSetting(field *bool) setting {
+	return setting{
+		get: func() string { return strconv.FormatBool(*field) },
+		set: func(v string) (err error) { *field, err = strconv.ParseBool(v); return err },
+	}
+}
+
+func intSetting(field *int) setting {
+	return setting{
+		get: func() string { return strconv.Itoa(*field) },
+		set: func(v string) (err error) { *field, err = strconv.Atoi(v); return err },
+	}
+}
+
+func durationSetting(field *time.Duration) setting {
+	return setting{
+		get: func() string { return field.String() },
+		set: func(v string) (err error) { *field, err = time.ParseDuration(v); return err },
+	}
+}
+
+// SettingNames returns the names of the runtime settings, sorted.
+func SettingNames() []string {
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// SettingValue returns the current value of a runtime setting as a string.
+func SettingValue(name string) string {
+	return settings[name].get()
+}
+
+// ConfigLayers reads the layers that override the workspace file: the workspace
+// file itself, the local workspace file, the user config and the environment.
+// Missing files are skipped.
+func ConfigLayers() ([]obj.ConfigLayer, error) {
+	layers := []obj.ConfigLayer{{Origin: obj.WorkspaceFile, Overrides: Config.WorkspaceConfig.Overrides}}
+
+	files := map[string]string{LocalWorkspaceFile: filepath.Join(Config.WorkspaceDir, LocalWorkspaceFile)}
+	origins := []string{LocalWorkspaceFile}
+	if userConfig := userConfigFile(); userConfig != "" {
+		files[userConfig] = userConfig
+		origins = append(origins, userConfig)
+	}
+	for _, origin := range origins {
+		overrides, err := readOverrides(files[origin])
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		layers = append(layers, obj.ConfigLayer{Origin: origin, Overrides: overrides})
+	}
+
+	return append(layers, obj.ConfigLayer{Origin: "environment", Overrides: environmentOverrides()}), nil
+}
+
+// ProfileLayers returns the layers of the named profiles of the workspace file,
+// in the order they are given.
+func ProfileLayers(names []string) ([]obj.ConfigLayer, error) {
+	var layers []obj.ConfigLayer
+	for _, name := range names {
+		profile, ok := Config.WorkspaceConfig.Profiles[name]
+		if !ok {
+			available := make([]string, 0, len(Config.WorkspaceConfig.Profiles))
+			for profileName := range Config.WorkspaceConfig.Profiles {
+				available = append(available, profileName)
+			}
+			sort.Strings(available)
+			if len(available) == 0 {
+				return nil, fmt.Errorf("unknown profile '%s', %s defines no profiles", name, obj.WorkspaceFile)
+			}
+			return nil, fmt.Errorf("unknown profile '%s', expected one of %s", name, strings.Join(available, ", "))
+		}
+		layers = append(layers, obj.ConfigLayer{Origin: "profile " + name, Overrides: profile})
+	}
+	return layers, nil
+}
+
+// ApplyLayers applies the runtime settings of every layer in order and keeps the
+// layers so their config overrides can be applied to targets. Config.Origins
+// records the layer each setting came from.
+func ApplyLayers(layers []obj.ConfigLayer) error {
+	Config.Layers = layers
+	Config.Origins = make(map[string]string)
+
+	var errs []error
+	for _, layer := range layers {
+		names := make([]string, 0, len(layer.Overrides.Settings))
+		for name := range layer.Overrides.Settings {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			s, ok := settings[name]
+			if !ok {
+				errs = append(errs, fmt.Errorf("%s: unknown setting '%s', expected one of %s", layer.Origin, name, strings.Join(SettingNames(), ", ")))
+				continue
+			}
+			if err := s.set(layer.Overrides.Settings[name]); err != nil {
+				errs = append(errs, fmt.Errorf("%s: invalid value for setting '%s': %s", layer.Origin, name, err.Error()))
+				continue
+			}
+			Config.Origins[name] = layer.Origin
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func readOverrides(file string) (obj.Overrides, error) {
+	var overrides obj.Overrides
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return overrides, err
+	}
+	if err := yaml.UnmarshalStrict(data, &overrides); err != nil {
+		return overrides, fmt.Errorf("failed to parse %s: %s", file, err.Error())
+	}
+	return overrides, nil
+}
+
+// userConfigFile returns the path of the config file of the user, which lives
+// in $XDG_CONFIG_HOME or ~/.config.
+func userConfigFile() string {
+	configHome := os.Getenv("XDG_CONFIG_HOME")
+	if configHome == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		configHome = filepath.Join(home, ".config")
+	}
+	return filepath.Join(configHome, "kamaji", "config.yaml")
+}
+
+// environmentOverrides reads KAMAJI_<SETTING> variables, such as KAMAJI_PYTHON,
+// and KAMAJI_CONFIG_<KEY> variables, which override the config key in lower
+// case.
+func environmentOverrides() obj.Overrides {
+	overrides := obj.Overrides{Settings: make(map[string]string), Config: make(map[string]any)}
+	for _, name := range SettingNames() {
+		if value, ok := os.LookupEnv("KAMAJI_" + strings.ToUpper(name)); ok {
+			overrides.Settings[name] = value
+		}
+	}
+
+	for _, entry := range os.Environ() {
+		name, value, _ := strings.Cut(entry, "=")
+		key, ok := strings.CutPrefix(name, "KAMAJI_CONFIG_")
+		if !ok || key == "" {
+			continue
+		}
+		overrides.Config[strings.ToLower(key)] = obj.RawOverride(value)
+	}
+	return overrides
+}
@@ -54,7 +54,7 @@ def _main() -> None:
         logging.error("AWS Region is not set")
         return 1
 
-    ORG_DOMAIN = os.environ.get("KAMAJI_ORGANIZATION_DOMAIN")
+    ORG_DOMAIN = os.environ.get("KAMAJI_VAR_ORG_DOMAIN") or os.environ.get("KAMAJI_ORGANIZATION_DOMAIN")
 
     base_dir = os.path.dirname(os.path.dirname(os.path.abspath(__file__)))
     common_dir = os.path.join(base_dir, "common")
@@ -62,7 +62,7 @@ def _main() -> None:
     from terraform import TerraformRunner
 
     if not ORG_DOMAIN:
-        logging.error("Can't find KAMAJI_ORGANIZATION_DOMAIN environment variable")
+        logging.error("Can't find KAMAJI_VAR_ORG_DOMAIN environment variable, set org_domain in workspace_vars")
         os.exit(1)
     else:
         logger.debug("ORG_DOMAIN: %s" % ORG_DOMAIN)
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"kamaji/label"
+	"kamaji/obj"
+	"kamaji/rt"
+	"kamaji/runner"
+	"kamaji/target"
+	"kamaji/tools"
+	"log"
+	"os"
+	"strings"
+)
+
+// resolveTargets turns the target names and patterns of the command line into
+// targets. Tags only filter the targets selected by patterns; targets named
+// explicitly are always kept.
+func resolveTargets(args []string, buildFileName string, tags []string) ([]obj.ExecTarget, error) {
+	var targets []obj.ExecTarget
+	for _, arg := range args {
+		arg = strings.TrimSpace(arg)
+
+		if !label.IsPattern(arg) {
+			execTarget, err := target.ResolveTarget(arg, buildFileName)
+			if err != nil {
+				return nil, fmt.Errorf("error resolving target %s: %s", arg, err.Error())
+			}
+			targets = append(targets, execTarget)
+			continue
+		}
+
+		pkg, err := label.PackageOf(".")
+		if err != nil {
+			return nil, err
+		}
+		pattern, err := label.ParsePattern(arg, pkg)
+		if err != nil {
+			return nil, err
+		}
+		selected, err := target.SelectTargets(pattern, buildFileName, tags)
+		if err != nil {
+			return nil, fmt.Errorf("error selecting targets %s: %s", arg, err.Error())
+		}
+		targets = append(targets, selected...)
+	}
+	return targets, nil
+}
+
+// runGraph runs the targets of g in dependency order, up to rt.Config.Jobs at a
+// time. A target is skipped when one of its dependencies failed, while targets
+// that do not depend on a failed one still run. Nothing else is started once
+// ctx is cancelled.
+func runGraph(ctx context.Context, g *target.Graph, pythonArgs []string) error {
+	type result struct {
+		key string
+		err error
+	}
+
+	jobs := max(rt.Config.Jobs, 1)
+	parallel := jobs > 1 && len(g.Order) > 1
+
+	started := make(map[string]bool)
+	finished := make(map[string]bool)
+	failed := make(map[string]bool)
+	results := make(chan result)
+	running := 0
+	var errs []error
+
+	for {
+		for _, key := range g.Order {
+			if started[key] || running >= jobs || ctx.Err() != nil {
+				continue
+			}
+
+			execTarget := g.Targets[key]
+			if dep := failedDependency(g, key, failed); dep != "" {
+				started[key], finished[key], failed[key] = true, true, true
+				fmt.Fprintf(os.Stderr, "Skipping target %s: dependency %s failed\n", execTarget.Label, g.Targets[dep].Label)
+				continue
+			}
+			if !dependenciesFinished(g, key, finished) {
+				continue
+			}
+
+			started[key] = true
+			running++
+			go func() {
+				results <- result{key: key, err: runTarget(ctx, execTarget, pythonArgs, parallel)}
+			}()
+		}
+
+		if running == 0 {
+			break
+		}
+
+		r := <-results
+		running--
+		finished[r.key] = true
+		if r.err != nil {
+			failed[r.key] = true
+			errs = append(errs, r.err)
+			reportRunError(g.Targets[r.key], r.err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func failedDependency(g *target.Graph, key string, failed map[string]bool) string {
+	for _, dep := range g.Deps[key] {
+		if failed[dep] {
+			return dep
+		}
+	}
+	return ""
+}
+
+func dependenciesFinished(g *target.Graph, key string, finished map[string]bool) bool {
+	for _, dep := range g.Deps[key] {
+		if !finished[dep] {
+			return false
+		}
+	}
+	return true
+}
+
+// runTarget downloads the third parties of a single target, runs its rule and
+// removes its execroot. When targets run in parallel the rule gets no stdin and
+// its output is prefixed with the label of the target.
+func runTarget(ctx context.Context, execTarget obj.ExecTarget, pythonArgs []string, parallel bool) error {
+	if rt.Config.DebugMode {
+		log.Printf("Running target %s\n", execTarget.Label)
+	}
+
+	run := &obj.TargetRun{
+		Target:               execTarget,
+		ThirdPartyFiles:      make(map[string]obj.ThirdPartyFileInfo),
+		ThirdPartyFinalPaths: make(map[string]string),
+		Stdin:                os.Stdin,
+		Stdout:               os.Stdout,
+		Stderr:               os.Stderr,
+	}
+	if parallel {
+		prefix := fmt.Sprintf("[%s] ", execTarget.Label)
+		stdout := tools.NewPrefixWriter(os.Stdout, prefix)
+		stderr := tools.NewPrefixWriter(os.Stderr, prefix)
+		defer stdout.Flush()
+		defer stderr.Flush()
+		run.Stdin, run.Stdout, run.Stderr = nil, stdout, stderr
+	}
+
+	err := target.InitThirdPartyUsedInTarget(ctx, rt.Config.WorkspaceConfig, run)
+	if err != nil {
+		return fmt.Errorf("error initializing third party used in target: %w", err)
+	}
+
+	runErr := runner.Run(ctx, rt.Config.WorkspaceConfig, run, pythonArgs...)
+
+	if err := cleanupExecRoot(run); err != nil {
+		log.Printf("Error removing execroot directory: %s\n", err.Error())
+		if runErr == nil {
+			return err
+		}
+	}
+
+	return runErr
+}
+
+func reportRunError(execTarget obj.ExecTarget, err error) {
+	var exitErr *runner.ExitError
+	var timeoutErr *runner.TimeoutError
+	var interrupted *runner.InterruptedError
+	if errors.As(err, &exitErr) || errors.As(err, &timeoutErr) || errors.As(err, &interrupted) {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		return
+	}
+	log.Printf("Error running target %s: %s\n", execTarget.Label, err.Error())
+}
+
+// exitCode maps the error of a run to the exit status of Kamaji: the status of
+// the first rule that failed, 124 for a timeout and 128+signal for an interrupt.
+func exitCode(err error) int {
+	var exitErr *runner.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.Code
+	}
+	var timeoutErr *runner.TimeoutError
+	if errors.As(err, &timeoutErr) {
+		return runner.TimeoutExitCode
+	}
+	var interrupted *runner.InterruptedError
+	if errors.As(err, &interrupted) {
+		return 128 + int(interrupted.Signal)
+	}
+	return 1
+}
+
+// cleanupExecRoot removes the execroot of run unless it has to be kept.
+func cleanupExecRoot(run *obj.TargetRun) error {
+	if run.ExecRootDir == "" {
+		return nil
+	}
+
+	if rt.Config.KeepExecRoot {
+		fmt.Fprintf(run.Stdout, "Keeping execroot directory: %s\n", run.ExecRootDir)
+		return nil
+	}
+
+	if rt.Config.DebugMode {
+		log.Printf("Cleaning up execroot directory: %s\n", run.ExecRootDir)
+	}
+	return os.RemoveAll(run.ExecRootDir)
+}
@@ -0,0 +1,152 @@
+package runner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"kamaji/obj"
+	"kamaji/rt"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// InterruptedError is the cancellation cause used when Kamaji itself receives
+// a signal. The signal is forwarded to the process group of the running rule.
+type InterruptedError struct {
+	Signal syscall.Signal
+}
+
+func (e *InterruptedError) Error() string {
+	return fmt.Sprintf("interrupted by signal %s", e.Signal)
+}
+
+// TimeoutExitCode is the exit status Kamaji uses when a target runs past its
+// timeout, matching the one of timeout(1).
+const TimeoutExitCode = 124
+
+// TimeoutError is returned by Run when the rule of a target ran past its timeout.
+type TimeoutError struct {
+	Target  string
+	Timeout time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("target %s timed out after %s", e.Target, e.Timeout)
+}
+
+// targetTimeout returns the timeout of target, with the --timeout flag taking
+// precedence over the timeout field of the build file. Zero means no timeout.
+func targetTimeout(target obj.ExecTarget) (time.Duration, error) {
+	if rt.Config.Timeout > 0 {
+		return rt.Config.Timeout, nil
+	}
+	if target.Timeout == "" {
+		return 0, nil
+	}
+
+	timeout, err := time.ParseDuration(target.Timeout)
+	if err != nil {
+		return 0, fmt.Errorf("invalid timeout for target %s: %s", target.Name, err.Error())
+	}
+	return timeout, nil
+}
+
+// cancelSignal returns the signal to forward to the rule once ctx is done.
+func cancelSignal(ctx context.Context) syscall.Signal {
+	var interrupted *InterruptedError
+	if errors.As(context.Cause(ctx), &interrupted) {
+		return interrupted.Signal
+	}
+	return syscall.SIGTERM
+}
+
+// runProcess runs cmd in its own process group and waits for it. When ctx is
+// cancelled the signal that caused it is forwarded to the whole group, and if the
+// group is still alive after the grace period it is killed with SIGKILL, so the
+// processes started by the rule are stopped along with it.
+//
+// A rule whose stdin is the terminal Kamaji runs in the foreground of gets the
+// terminal for its process group, so it can prompt the user and Ctrl-C reaches
+// every process of the rule, as it would for a command run by the shell. Kamaji
+// takes the terminal back once the rule has exited.
+func runProcess(ctx context.Context, cmd *exec.Cmd) error {
+	if err := ctx.Err(); err != nil {
+		return context.Cause(ctx)
+	}
+
+	ttyFd, foreground := 0, false
+	if cmd.Stdin == os.Stdin {
+		ttyFd, foreground = foregroundTTY()
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if foreground {
+		cmd.SysProcAttr.Foreground = true
+		cmd.SysProcAttr.Ctty = ttyFd
+	}
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	if foreground {
+		defer reclaimTTY(ttyFd)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+	}
+
+	pgid := cmd.Process.Pid
+	sig := cancelSignal(ctx)
+	if rt.Config.DebugMode {
+		log.Printf("Forwarding %s to process group %d\n", sig, pgid)
+	}
+	syscall.Kill(-pgid, sig)
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(rt.Config.GracePeriod):
+	}
+
+	fmt.Fprintf(os.Stderr, "Process group %d did not exit within %s, killing it\n", pgid, rt.Config.GracePeriod)
+	syscall.Kill(-pgid, syscall.SIGKILL)
+	return <-done
+}
+
+// foregroundTTY reports whether stdin is a terminal whose foreground process
+// group is the one of Kamaji, and returns its descriptor.
+func foregroundTTY() (int, bool) {
+	fd := int(os.Stdin.Fd())
+	var pgrp int32
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), uintptr(syscall.TIOCGPGRP), uintptr(unsafe.Pointer(&pgrp))); errno != 0 {
+		return 0, false
+	}
+	return fd, int(pgrp) == syscall.Getpgrp()
+}
+
+// reclaimTTY moves the process group of Kamaji back to the foreground of the
+// terminal. SIGTTOU is ignored meanwhile since Kamaji is a background process
+// until the call succeeds.
+func reclaimTTY(fd int) {
+	signal.Ignore(syscall.SIGTTOU)
+	defer signal.Reset(syscall.SIGTTOU)
+
+	pgrp := int32(syscall.Getpgrp())
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), uintptr(syscall.TIOCSPGRP), uintptr(unsafe.Pointer(&pgrp))); errno != 0 {
+		if rt.Config.DebugMode {
+			log.Printf("Cannot reclaim the terminal: %s\n", errno.Error())
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package runner
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -12,27 +13,62 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
 	"strings"
+	"syscall"
 )
 
-func prepareCmdline(python_executable string, target obj.ExecTarget) (string, error) {
-	convertToJSON := func(value any) (string, error) {
+// ExitError is returned by Run when the rule exits with a non-zero status or is
+// terminated by a signal. Code follows the shell convention of 128+signal for
+// the latter, so it can be used as the exit status of Kamaji itself.
+type ExitError struct {
+	Target string
+	Code   int
+	Signal syscall.Signal
+}
+
+func (e *ExitError) Error() string {
+	if e.Signal != 0 {
+		return fmt.Sprintf("target %s was terminated by signal %s", e.Target, e.Signal)
+	}
+	return fmt.Sprintf("target %s exited with status %d", e.Target, e.Code)
+}
+
+func newExitError(targetLabel string, exitErr *exec.ExitError) *ExitError {
+	if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return &ExitError{
+			Target: targetLabel,
+			Code:   128 + int(status.Signal()),
+			Signal: status.Signal(),
+		}
+	}
+	return &ExitError{
+		Target: targetLabel,
+		Code:   exitErr.ExitCode(),
+	}
+}
+
+// PrepareCmdline builds the argument vector that runs the rule of target: the
+// interpreter, the rule path and one --key=value entry per config key. Values
+// referencing third party files with @@ are replaced by their entry in finalPaths.
+// Every value is passed as its own argument, so it reaches the rule byte-for-byte.
+func PrepareCmdline(python_executable string, target obj.ExecTarget, finalPaths map[string]string) ([]string, error) {
+	convertToArg := func(value any) (string, error) {
 		switch v := value.(type) {
-		case map[any]any:
-			normalizedMap := tools.NormalizeMap(v)
-			jsonBytes, err := json.Marshal(normalizedMap)
+		case map[any]any, map[string]any, []any:
+			jsonBytes, err := json.Marshal(tools.NormalizeValue(v))
 			if err != nil {
-				return "", errors.New("error marshaling map to JSON")
+				return "", errors.New("error marshaling value to JSON")
 			}
-			return fmt.Sprintf("'%s'", string(jsonBytes)), nil
+			return string(jsonBytes), nil
 		case string:
 			if strings.HasPrefix(v, "@@") {
 				if rt.Config.DebugMode {
 					log.Printf("Resolving third party file: %s\n", v)
-					log.Printf("Third party final paths: %+v\n", rt.Config.ThirdPartyFinalPaths)
+					log.Printf("Third party final paths: %+v\n", finalPaths)
 				}
 				resolvedKey := v[2:]
-				if resolvedPath, exists := rt.Config.ThirdPartyFinalPaths[resolvedKey]; exists {
+				if resolvedPath, exists := finalPaths[resolvedKey]; exists {
 					return resolvedPath, nil
 				} else {
 					return "", fmt.Errorf("third party file not found: %s", resolvedKey)
@@ -46,64 +82,120 @@ func prepareCmdline(python_executable string, target obj.ExecTarget) (string, er
 		}
 	}
 
-	cmdline := fmt.Sprintf("%s %s/%s", python_executable, rt.Config.WorkspaceConfig.RulesDir, target.Rule)
-	for k, v := range target.Config {
-		jsonValue, err := convertToJSON(v)
+	argv := []string{python_executable, filepath.Join(rt.Config.WorkspaceConfig.RulesDir, target.Rule)}
+
+	keys := make([]string, 0, len(target.Config))
+	for k := range target.Config {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		arg, err := convertToArg(target.Config[k])
 		if err != nil {
-			return "", err
+			return nil, err
 		}
-		cmdline += fmt.Sprintf(" --%s=%s", k, jsonValue)
+		argv = append(argv, fmt.Sprintf("--%s=%s", k, arg))
 	}
 
-	return cmdline, nil
+	return argv, nil
 }
 
-func Run(workspaceConfig obj.WorkspaceConfig, target obj.ExecTarget, pythonArgs ...string) error {
-	// Use the Python interpreter provided via CLI if available; otherwise, look it up.
-	python_executable := rt.Config.PythonInterpreter
-	var err error
-	if python_executable == "" {
-		python_executable, err = exec.LookPath("python")
-		if err != nil {
-			if rt.Config.DebugMode {
-				log.Printf("python not found in path: %v\n", err)
-			}
-			return errors.New("python not found in path")
+// PythonInterpreter returns the interpreter provided via CLI if available;
+// otherwise, it looks python up in the PATH.
+func PythonInterpreter() (string, error) {
+	if rt.Config.PythonInterpreter != "" {
+		return rt.Config.PythonInterpreter, nil
+	}
+
+	python_executable, err := exec.LookPath("python")
+	if err != nil {
+		if rt.Config.DebugMode {
+			log.Printf("python not found in path: %v\n", err)
 		}
+		return "", errors.New("python not found in path")
 	}
-	if rt.Config.DebugMode {
-		log.Printf("Using python interpreter: %s\n", python_executable)
+	return python_executable, nil
+}
+
+// Environment returns the variables Kamaji injects into the environment of a rule
+// on top of its own environment. Every workspace variable is exported as
+// KAMAJI_VAR_<NAME>, and org_domain also as KAMAJI_ORGANIZATION_DOMAIN, which
+// older rules read.
+func Environment(workspaceConfig obj.WorkspaceConfig) []string {
+	names := make([]string, 0, len(workspaceConfig.WorkspaceVars))
+	for name := range workspaceConfig.WorkspaceVars {
+		names = append(names, name)
 	}
+	sort.Strings(names)
 
+	var env []string
+	if orgDomain, ok := workspaceConfig.WorkspaceVars["org_domain"]; ok {
+		env = append(env, "KAMAJI_ORGANIZATION_DOMAIN="+orgDomain)
+	}
+	for _, name := range names {
+		env = append(env, WorkspaceVarEnvName(name)+"="+workspaceConfig.WorkspaceVars[name])
+	}
+
+	pythonPath := workspaceConfig.RulesDir + "/" + workspaceConfig.RulesCommonDir
+	return append(env, "PYTHONPATH="+pythonPath)
+}
+
+// WorkspaceVarEnvName returns the environment variable a workspace variable is
+// exported as: its name in upper case, prefixed with KAMAJI_VAR_, with every
+// character that is not a letter, a digit or an underscore replaced by one.
+func WorkspaceVarEnvName(name string) string {
+	return "KAMAJI_VAR_" + strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' {
+			return r - 'a' + 'A'
+		}
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// Run prepares the execroot of the target of run and runs its rule with the
+// standard streams of run. Cancelling ctx forwards a signal to the rule, see
+// runProcess.
+func Run(ctx context.Context, workspaceConfig obj.WorkspaceConfig, run *obj.TargetRun, pythonArgs ...string) error {
+	target := run.Target
+
+	python_executable, err := PythonInterpreter()
+	if err != nil {
+		return err
+	}
 	if rt.Config.DebugMode {
-		log.Printf("Creating execroot dir: %s\n", rt.Config.ExecRootDir)
+		log.Printf("Using python interpreter: %s\n", python_executable)
 	}
-	err = execroot.CreateExecRootDir(target)
+
+	err = execroot.CreateExecRootDir(run)
 	if err != nil {
 		return err
 	}
 
 	if rt.Config.DebugMode {
-		log.Printf("Copying third party into execroot dir: %s\n", rt.Config.ExecRootDir)
+		log.Printf("Copying third party into execroot dir: %s\n", run.ExecRootDir)
 	}
-	err = execroot.CopyThirdPartyIntoExecRootDir()
+	err = execroot.CopyThirdPartyIntoExecRootDir(run)
 	if err != nil {
 		return err
 	}
 
 	if rt.Config.DebugMode {
-		log.Printf("Creating rules dir in execroot dir: %s\n", rt.Config.ExecRootDir)
+		log.Printf("Creating rules dir in execroot dir: %s\n", run.ExecRootDir)
 	}
-	rulesDirInExecRoot := filepath.Join(rt.Config.ExecRootDir, "rules")
+	rulesDirInExecRoot := filepath.Join(run.ExecRootDir, "rules")
 	err = os.MkdirAll(rulesDirInExecRoot, 0700)
 	if err != nil {
 		return err
 	}
 
-	commonDirInExecRoot := filepath.Join(rt.Config.ExecRootDir, "common")
+	commonDirInExecRoot := filepath.Join(run.ExecRootDir, "common")
 
 	if rt.Config.DebugMode {
-		log.Printf("Creating rule dir in execroot dir: %s\n", rt.Config.ExecRootDir)
+		log.Printf("Creating rule dir in execroot dir: %s\n", run.ExecRootDir)
 	}
 	ruleDir := filepath.Dir(target.Rule)
 	linkSource := filepath.Join(rt.Config.WorkspaceConfig.RulesDir, ruleDir)
@@ -115,7 +207,7 @@ func Run(workspaceConfig obj.WorkspaceConfig, target obj.ExecTarget, pythonArgs
 	}
 
 	if rt.Config.DebugMode {
-		log.Printf("Creating common dir in execroot dir: %s\n", rt.Config.ExecRootDir)
+		log.Printf("Creating common dir in execroot dir: %s\n", run.ExecRootDir)
 	}
 	linkSource = filepath.Join(rt.Config.WorkspaceConfig.RulesDir, "common")
 	err = os.Symlink(linkSource, commonDirInExecRoot)
@@ -128,10 +220,10 @@ func Run(workspaceConfig obj.WorkspaceConfig, target obj.ExecTarget, pythonArgs
 
 	if rt.Config.Isolated {
 		if rt.Config.DebugMode {
-			log.Printf("Mirroring directory with sym links: %s\n", rt.Config.ExecRootDir)
+			log.Printf("Mirroring directory with sym links: %s\n", run.ExecRootDir)
 		}
-		targetDir := filepath.Join(rt.Config.ExecRootDir, "origin")
-		sourceDir := os.Getenv("PWD")
+		targetDir := filepath.Join(run.ExecRootDir, "origin")
+		sourceDir := target.Dir
 		err = tools.MirrorDirectoryWithSymLinks(sourceDir, targetDir)
 		if err != nil {
 			return err
@@ -141,42 +233,56 @@ func Run(workspaceConfig obj.WorkspaceConfig, target obj.ExecTarget, pythonArgs
 	if rt.Config.DebugMode {
 		log.Printf("Preparing cmdline for target: %s\n", target.Name)
 	}
-	cmdline, err := prepareCmdline(python_executable, target)
+	argv, err := PrepareCmdline(python_executable, target, run.ThirdPartyFinalPaths)
 	if err != nil {
 		return err
 	}
+	argv = append(argv, pythonArgs...)
 
-	if cmdline == "" {
-		return errors.New("cmdline could not be prepared")
-	}
-
-	if len(pythonArgs) > 0 {
-		cmdline += " " + strings.Join(pythonArgs, " ")
+	if rt.Config.DebugMode {
+		log.Printf("Running command:\n%s\n", tools.ShellQuote(argv))
 	}
 
-	if rt.Config.DebugMode {
-		log.Printf("Running command:\n%s\n", cmdline)
+	if rt.Config.DryRun {
+		fmt.Fprintf(run.Stdout, "Command:\n  %s\n\nExecroot %s:\n", tools.ShellQuote(argv), run.ExecRootDir)
+		return execroot.PrintLayout(run.Stdout, run.ExecRootDir)
 	}
 
-	pythonPath := workspaceConfig.RulesDir + "/" + rt.Config.WorkspaceConfig.RulesCommonDir
-	cmd := exec.Command("bash", "-c", cmdline)
+	cmd := exec.Command(argv[0], argv[1:]...)
 
 	if rt.Config.Isolated {
-		cmd.Dir = rt.Config.ExecRootDir + "/" + "origin"
+		cmd.Dir = run.ExecRootDir + "/" + "origin"
 	} else {
-		cmd.Dir = os.Getenv("PWD")
+		cmd.Dir = target.Dir
 	}
 	cmd.Env = os.Environ()
-	cmd.Env = append(cmd.Env, "KAMAJI_ORGANIZATION_DOMAIN="+workspaceConfig.WorkspaceVars[0].Org_Domain)
-	cmd.Env = append(cmd.Env, "PYTHONPATH="+pythonPath)
+	cmd.Env = append(cmd.Env, Environment(workspaceConfig)...)
+
+	cmd.Stdin = run.Stdin
+	cmd.Stdout = run.Stdout
+	cmd.Stderr = run.Stderr
 
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	timeout, err := targetTimeout(target)
+	if err != nil {
+		return err
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, timeout, &TimeoutError{Target: target.Label, Timeout: timeout})
+		defer cancel()
+	}
 
-	err = cmd.Run()
+	err = runProcess(ctx, cmd)
+	var timeoutErr *TimeoutError
+	if errors.As(context.Cause(ctx), &timeoutErr) {
+		return timeoutErr
+	}
 	if err != nil {
-		log.Fatalf("Command execution failed: %v", err)
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return newExitError(target.Label, exitErr)
+		}
+		return fmt.Errorf("command execution failed: %s", err.Error())
 	}
 
 	return nil
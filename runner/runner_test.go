@@ -0,0 +1,109 @@
+package runner
+
+import (
+	"kamaji/obj"
+	"kamaji/rt"
+	"slices"
+	"testing"
+)
+
+func TestPrepareCmdline(t *testing.T) {
+	rt.Config.WorkspaceConfig.RulesDir = "/ws/rules"
+	finalPaths := map[string]string{
+		"terraform_1_10_5": "/cache/abc/__TMP__/terraform",
+		"with space":       "/cache/d e f/__TMP__/tool",
+	}
+
+	tests := []struct {
+		name   string
+		config map[string]any
+		want   []string
+	}{
+		{
+			name:   "spaces",
+			config: map[string]any{"msg": "hello world  twice"},
+			want:   []string{"--msg=hello world  twice"},
+		},
+		{
+			name:   "single and double quotes",
+			config: map[string]any{"a": `it's`, "b": `say "hi"`, "c": `'"'`},
+			want:   []string{`--a=it's`, `--b=say "hi"`, `--c='"'`},
+		},
+		{
+			name:   "shell expansions are not expanded",
+			config: map[string]any{"home": "$HOME", "braces": "${HOME}/x", "cmd": "`rm -rf /`", "sub": "$(id)"},
+			want:   []string{"--braces=${HOME}/x", "--cmd=`rm -rf /`", "--home=$HOME", "--sub=$(id)"},
+		},
+		{
+			name:   "newlines",
+			config: map[string]any{"script": "line one\nline two\n"},
+			want:   []string{"--script=line one\nline two\n"},
+		},
+		{
+			name:   "equals signs",
+			config: map[string]any{"kv": "a=b=c", "empty_key": "="},
+			want:   []string{"--empty_key==", "--kv=a=b=c"},
+		},
+		{
+			name:   "empty string",
+			config: map[string]any{"empty": ""},
+			want:   []string{"--empty="},
+		},
+		{
+			name:   "scalars",
+			config: map[string]any{"count": 3, "ratio": 0.5, "enabled": true, "disabled": false},
+			want:   []string{"--count=3", "--disabled=false", "--enabled=true", "--ratio=0.5"},
+		},
+		{
+			name: "nested maps and lists as JSON",
+			config: map[string]any{
+				"tags":   map[any]any{"team": "infra", "note": `it's "quoted"`},
+				"zones":  []any{"a", "b c", 1},
+				"nested": map[string]any{"list": []any{map[any]any{"k": "$HOME"}}},
+			},
+			want: []string{
+				`--nested={"list":[{"k":"$HOME"}]}`,
+				`--tags={"note":"it's \"quoted\"","team":"infra"}`,
+				`--zones=["a","b c",1]`,
+			},
+		},
+		{
+			name:   "third party references",
+			config: map[string]any{"terraform": "@@terraform_1_10_5", "tool": "@@with space"},
+			want:   []string{"--terraform=/cache/abc/__TMP__/terraform", "--tool=/cache/d e f/__TMP__/tool"},
+		},
+		{
+			name:   "@@ inside a value is kept",
+			config: map[string]any{"email": "me@@example.com"},
+			want:   []string{"--email=me@@example.com"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := obj.ExecTarget{Name: "t", Rule: "echo/echo.py", Config: tt.config}
+			argv, err := PrepareCmdline("/usr/bin/python3", target, finalPaths)
+			if err != nil {
+				t.Fatalf("PrepareCmdline() error = %v", err)
+			}
+
+			want := append([]string{"/usr/bin/python3", "/ws/rules/echo/echo.py"}, tt.want...)
+			if !slices.Equal(argv, want) {
+				t.Errorf("PrepareCmdline() =\n%q\nwant\n%q", argv, want)
+			}
+		})
+	}
+}
+
+func TestPrepareCmdlineMissingThirdParty(t *testing.T) {
+	rt.Config.WorkspaceConfig.RulesDir = "/ws/rules"
+	target := obj.ExecTarget{Name: "t", Rule: "echo/echo.py", Config: map[string]any{"tool": "@@kubectl_1_32_1"}}
+
+	_, err := PrepareCmdline("python", target, map[string]string{"helm": "/cache/helm"})
+	if err == nil {
+		t.Fatal("PrepareCmdline() error = nil, want an error for the missing third party")
+	}
+	if want := "third party file not found: kubectl_1_32_1"; err.Error() != want {
+		t.Errorf("PrepareCmdline() error = %q, want %q", err.Error(), want)
+	}
+}
@@ -0,0 +1,218 @@
+package target
+
+import (
+	"fmt"
+	"kamaji/obj"
+	"kamaji/rt"
+	"kamaji/tools"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// AffectedTargets returns the targets of the workspace affected by the changed
+// files, sorted by label. A file affects every target of the package that owns
+// it or that includes it, a file of a rule directory the targets using that rule
+// and a file of the common rules directory every target. Targets that depend on
+// an affected target are affected as well.
+//
+// oldWorkspaceFile is the content of the workspace file before the change, so
+// that only targets using a changed third party are affected by it. When it is
+// nil, a change to the workspace file affects every target.
+func AffectedTargets(changedFiles []string, buildFileName string, oldWorkspaceFile []byte) ([]obj.ExecTarget, error) {
+	buildFiles, err := FindBuildFiles(rt.Config.WorkspaceDir, filepath.Base(buildFileName))
+	if err != nil {
+		return nil, err
+	}
+
+	var targets []obj.ExecTarget
+	packages := make(map[string]bool)
+	includedBy := make(map[string][]string)
+	for _, file := range buildFiles {
+		buildFile, err := LoadBuildFile(file)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, buildFile.Targets...)
+		packages[filepath.Dir(file)] = true
+		for _, fragment := range buildFile.Fragments {
+			includedBy[fragment] = append(includedBy[fragment], filepath.Dir(file))
+		}
+	}
+
+	rulesDir, err := filepath.Abs(rt.Config.WorkspaceConfig.RulesDir)
+	if err != nil {
+		return nil, err
+	}
+	commonDir := filepath.Join(rulesDir, rt.Config.WorkspaceConfig.RulesCommonDir)
+	workspaceFile := filepath.Join(rt.Config.WorkspaceDir, obj.WorkspaceFile)
+
+	changedPackages := make(map[string]bool)
+	var changedRuleFiles []string
+	var changedThirdParty map[string]bool
+	all := false
+
+	for _, file := range changedFiles {
+		switch {
+		case file == workspaceFile:
+			changedThirdParty, all, err = workspaceChanges(oldWorkspaceFile, workspaceFile)
+			if err != nil {
+				return nil, err
+			}
+		case isWithin(file, commonDir) && rt.Config.WorkspaceConfig.RulesCommonDir != "":
+			all = true
+		case isWithin(file, rulesDir):
+			changedRuleFiles = append(changedRuleFiles, file)
+		default:
+			if dir := owningPackage(file, packages); dir != "" {
+				changedPackages[dir] = true
+			}
+			for _, dir := range includedBy[file] {
+				changedPackages[dir] = true
+			}
+		}
+		if rt.Config.DebugMode {
+			log.Printf("Changed file %s\n", file)
+		}
+	}
+
+	affected := make(map[string]bool)
+	for _, target := range targets {
+		if all || changedPackages[target.Dir] || changesRule(target, rulesDir, changedRuleFiles) || usesAny(target, changedThirdParty) {
+			affected[Key(target)] = true
+		}
+	}
+
+	graph, err := BuildGraph(targets)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []obj.ExecTarget
+	for _, key := range graph.Order {
+		for _, dep := range graph.Deps[key] {
+			if affected[dep] {
+				affected[key] = true
+			}
+		}
+		if affected[key] {
+			result = append(result, graph.Targets[key])
+		}
+	}
+
+	slices.SortFunc(result, func(a, b obj.ExecTarget) int {
+		return strings.Compare(a.Label, b.Label)
+	})
+	return result, nil
+}
+
+// workspaceChanges compares the workspace file with its old content. It returns
+// the names of the third parties that were added, removed or changed, and
+// whether anything else changed, which affects every target.
+func workspaceChanges(oldContent []byte, workspaceFile string) (map[string]bool, bool, error) {
+	if oldContent == nil {
+		return nil, true, nil
+	}
+
+	newContent, err := os.ReadFile(workspaceFile)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var oldConfig, newConfig obj.WorkspaceConfig
+	if err := yaml.Unmarshal(oldContent, &oldConfig); err != nil {
+		return nil, false, fmt.Errorf("failed to parse old %s: %s", obj.WorkspaceFile, err.Error())
+	}
+	if err := yaml.Unmarshal(newContent, &newConfig); err != nil {
+		return nil, false, fmt.Errorf("failed to parse %s: %s", workspaceFile, err.Error())
+	}
+
+	changed := make(map[string]bool)
+	oldThirdParty := thirdPartyByName(oldConfig.ThirdParty)
+	newThirdParty := thirdPartyByName(newConfig.ThirdParty)
+	for name, tp := range oldThirdParty {
+		if other, ok := newThirdParty[name]; !ok || !reflect.DeepEqual(tp, other) {
+			changed[name] = true
+		}
+	}
+	for name := range newThirdParty {
+		if _, ok := oldThirdParty[name]; !ok {
+			changed[name] = true
+		}
+	}
+
+	oldConfig.ThirdParty, newConfig.ThirdParty = nil, nil
+	return changed, !reflect.DeepEqual(oldConfig, newConfig), nil
+}
+
+func thirdPartyByName(thirdParty []obj.ThirdPartyConfig) map[string]obj.ThirdPartyConfig {
+	byName := make(map[string]obj.ThirdPartyConfig, len(thirdParty))
+	for _, tp := range thirdParty {
+		byName[tp.Name] = tp
+	}
+	return byName
+}
+
+// owningPackage returns the directory of the closest build file above file, or
+// an empty string when no package owns it.
+func owningPackage(file string, packages map[string]bool) string {
+	for dir := filepath.Dir(file); isWithin(dir, rt.Config.WorkspaceDir); dir = filepath.Dir(dir) {
+		if packages[dir] {
+			return dir
+		}
+		if dir == rt.Config.WorkspaceDir {
+			break
+		}
+	}
+	return ""
+}
+
+func usesAny(target obj.ExecTarget, thirdParty map[string]bool) bool {
+	if len(thirdParty) == 0 {
+		return false
+	}
+	for _, name := range resolvedReferences(target) {
+		if thirdParty[name] {
+			return true
+		}
+	}
+	return false
+}
+
+// resolvedReferences returns the third parties referenced by the target once
+// the config overrides and the defaults of its rule are applied, as they are
+// when it runs. The validation works on a copy, so the target is left as is.
+// The references of the config in the build file are included in case the
+// target does not validate.
+func resolvedReferences(target obj.ExecTarget) []string {
+	resolved := target
+	resolved.Config = tools.NormalizeValue(target.Config).(map[string]any)
+	resolved.Origins = maps.Clone(target.Origins)
+	if err := ValidateTargetVariables(&resolved); err != nil && rt.Config.DebugMode {
+		log.Printf("Cannot resolve the config of target %s: %s\n", target.Label, err.Error())
+	}
+	return append(ThirdPartyReferences(target), ThirdPartyReferences(resolved)...)
+}
+
+// changesRule reports whether one of the changed files is in the directory of
+// the rule of the target, subdirectories included, since the whole directory is
+// linked into the execroot.
+func changesRule(target obj.ExecTarget, rulesDir string, changedFiles []string) bool {
+	ruleDir := filepath.Join(rulesDir, filepath.Dir(target.Rule))
+	for _, file := range changedFiles {
+		if isWithin(file, ruleDir) {
+			return true
+		}
+	}
+	return false
+}
+
+func isWithin(path string, dir string) bool {
+	return path == dir || strings.HasPrefix(path, dir+string(filepath.Separator))
+}
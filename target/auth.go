@@ -0,0 +1,207 @@
+package target
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"kamaji/obj"
+	"kamaji/rt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// envReferencePattern matches the ${env.NAME} references of header values.
+var envReferencePattern = regexp.MustCompile(`\$\{env\.([^}]*)\}`)
+
+// authHeadersKey is the context key of the names of the headers authorize set,
+// so they can be dropped when a download is redirected to another host.
+type authHeadersKey struct{}
+
+// downloadAuth returns how the download of rawURL authenticates. The auth of the
+// third party applies to the hosts of its own URLs only, so it is not sent to a
+// mirror. Any other URL uses the download_auth of its host from the latest
+// config layer that defines one.
+func downloadAuth(thirdParty obj.ThirdPartyConfig, rawURL string) *obj.DownloadAuth {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil
+	}
+
+	if thirdParty.Auth != nil {
+		for _, own := range thirdParty.URLs[rt.Config.Platform] {
+			if ownURL, err := url.Parse(own); err == nil && ownURL.Host == u.Host {
+				return thirdParty.Auth
+			}
+		}
+	}
+
+	for i := len(rt.Config.Layers) - 1; i >= 0; i-- {
+		hosts := rt.Config.Layers[i].Overrides.Auth
+		if auth, ok := hosts[u.Host]; ok {
+			return &auth
+		}
+		if auth, ok := hosts[u.Hostname()]; ok {
+			return &auth
+		}
+	}
+	return nil
+}
+
+// authorize adds the credentials of auth to req. It returns a request whose
+// context remembers the headers that were set. Errors never contain credentials.
+func authorize(req *http.Request, auth *obj.DownloadAuth) (*http.Request, error) {
+	if auth == nil {
+		return req, nil
+	}
+
+	var headers []string
+	for name, value := range auth.Headers {
+		var missing []string
+		value = envReferencePattern.ReplaceAllStringFunc(value, func(reference string) string {
+			name := envReferencePattern.FindStringSubmatch(reference)[1]
+			envValue, ok := os.LookupEnv(name)
+			if !ok {
+				missing = append(missing, name)
+			}
+			return envValue
+		})
+		if len(missing) > 0 {
+			return nil, fmt.Errorf("header %s for %s needs the environment variable %s, which is not set", name, req.URL.Host, strings.Join(missing, ", "))
+		}
+		req.Header.Set(name, value)
+		headers = append(headers, name)
+	}
+
+	if auth.BearerTokenEnv != "" {
+		token := os.Getenv(auth.BearerTokenEnv)
+		if token == "" {
+			return nil, fmt.Errorf("the token for %s is read from the environment variable %s, which is not set", req.URL.Host, auth.BearerTokenEnv)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		headers = append(headers, "Authorization")
+	}
+
+	if auth.Netrc {
+		login, password, found, err := lookupNetrc(req.URL.Hostname())
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			req.SetBasicAuth(login, password)
+			headers = append(headers, "Authorization")
+		} else if rt.Config.DebugMode {
+			log.Printf("No netrc entry for %s\n", req.URL.Hostname())
+		}
+	}
+
+	return req.WithContext(context.WithValue(req.Context(), authHeadersKey{}, headers)), nil
+}
+
+// dropAuthOnRedirect removes the headers set by authorize when a download is
+// redirected to another host, for example from an artifact store to the
+// presigned URL of its object storage.
+func dropAuthOnRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+	if req.URL.Host != via[0].URL.Host {
+		headers, _ := req.Context().Value(authHeadersKey{}).([]string)
+		for _, name := range headers {
+			req.Header.Del(name)
+		}
+	}
+	return nil
+}
+
+// RedactURL hides the password of a URL with user info, so it can be logged.
+func RedactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	return u.Redacted()
+}
+
+// lookupNetrc returns the login and password of host from $NETRC or ~/.netrc,
+// falling back to the default entry.
+func lookupNetrc(host string) (login string, password string, found bool, err error) {
+	path := os.Getenv("NETRC")
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", "", false, nil
+		}
+		path = filepath.Join(home, ".netrc")
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", "", false, nil
+	}
+	if err != nil {
+		return "", "", false, fmt.Errorf("failed to read %s: %s", path, err.Error())
+	}
+
+	var tokens []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		tokens = append(tokens, strings.Fields(line)...)
+	}
+
+	var defaultLogin, defaultPassword string
+	hasDefault := false
+	matching, inDefault := false, false
+	for i := 0; i < len(tokens); i++ {
+		next := func() string {
+			if i+1 < len(tokens) {
+				i++
+				return tokens[i]
+			}
+			return ""
+		}
+
+		switch tokens[i] {
+		case "machine":
+			if matching {
+				return login, password, true, nil
+			}
+			matching, inDefault = next() == host, false
+		case "default":
+			if matching {
+				return login, password, true, nil
+			}
+			matching, inDefault, hasDefault = false, true, true
+		case "login":
+			value := next()
+			if matching {
+				login = value
+			} else if inDefault {
+				defaultLogin = value
+			}
+		case "password":
+			value := next()
+			if matching {
+				password = value
+			} else if inDefault {
+				defaultPassword = value
+			}
+		case "account", "macdef":
+			next()
+		}
+	}
+
+	if matching {
+		return login, password, true, nil
+	}
+	if hasDefault {
+		return defaultLogin, defaultPassword, true, nil
+	}
+	return "", "", false, nil
+}
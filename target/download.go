@@ -0,0 +1,284 @@
+package target
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"kamaji/obj"
+	"kamaji/rt"
+	"kamaji/tools"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+const maxParallelDownloads = 4
+
+// Failed downloads are retried downloadAttempts times, waiting downloadBackoff
+// at first and twice as long after every attempt, up to maxDownloadBackoff.
+var (
+	downloadAttempts   = 5
+	downloadBackoff    = time.Second
+	maxDownloadBackoff = 30 * time.Second
+)
+
+// downloadIdleTimeout cancels a download attempt when the server sends no data
+// for that long, so a stalled transfer is retried instead of hanging forever.
+var downloadIdleTimeout = 30 * time.Second
+
+// errDownloadStalled is the cancellation cause of an attempt that timed out.
+var errDownloadStalled = errors.New("download stalled")
+
+// downloadSlots bounds the number of downloads running at once, across all
+// targets.
+var downloadSlots = make(chan struct{}, maxParallelDownloads)
+
+// downloadClient gives up on servers that do not answer, but not on large files
+// that take long to transfer.
+var downloadClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+		TLSHandshakeTimeout:   30 * time.Second,
+		ResponseHeaderTimeout: time.Minute,
+		IdleConnTimeout:       90 * time.Second,
+	},
+	CheckRedirect: dropAuthOnRedirect,
+}
+
+// downloadSource is a URL a file can be downloaded from, together with the
+// credentials to send to it.
+type downloadSource struct {
+	url  string
+	auth *obj.DownloadAuth
+}
+
+// downloadFile downloads the file with the given sha256 into filePath from the
+// first of sources that serves it. The download is written to filePath.partial
+// and renamed into place only once its sha256 matches, so filePath is either
+// missing or complete.
+//
+// Every round of attempts tries the sources in order. A source that fails in a
+// way worth retrying, such as a refused connection or a 5xx response, is tried
+// again in the next round, and one that fails for good, such as with a 404, is
+// dropped. Rounds are separated by an exponential backoff, so the next source is
+// tried right away. An attempt resumes where the partial file ends when the
+// server supports range requests, whichever source the partial file came from:
+// they all serve the same file.
+func downloadFile(ctx context.Context, filePath string, sha256 string, sources ...downloadSource) error {
+	select {
+	case downloadSlots <- struct{}{}:
+		defer func() { <-downloadSlots }()
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	}
+
+	partialPath := filePath + ".partial"
+	errs := make([]error, len(sources))
+	failed := make([]bool, len(sources))
+	backoff := downloadBackoff
+	var lastErr error
+	for attempt := 1; attempt <= downloadAttempts; attempt++ {
+		if attempt > 1 {
+			log.Printf("Download of %s failed, retrying in %s (attempt %d of %d): %s\n", filePath, backoff, attempt, downloadAttempts, lastErr.Error())
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return context.Cause(ctx)
+			}
+			backoff = min(2*backoff, maxDownloadBackoff)
+		}
+
+		for i, source := range sources {
+			if failed[i] {
+				continue
+			}
+
+			retry, err := tryDownload(ctx, source, partialPath, sha256)
+			if ctx.Err() != nil {
+				return context.Cause(ctx)
+			}
+			if err == nil {
+				return os.Rename(partialPath, filePath)
+			}
+			errs[i], failed[i], lastErr = err, !retry, err
+			if slices.Contains(failed[i+1:], false) {
+				log.Printf("Download of %s from %s failed, trying the next URL: %s\n", filePath, RedactURL(source.url), err.Error())
+			}
+		}
+
+		if !slices.Contains(failed, false) {
+			os.Remove(partialPath)
+			if len(sources) == 1 {
+				return errs[0]
+			}
+			return fmt.Errorf("every URL failed:\n%w", sourceErrors(sources, errs))
+		}
+	}
+
+	if len(sources) == 1 {
+		return fmt.Errorf("giving up after %d attempts: %s", downloadAttempts, errs[0].Error())
+	}
+	return fmt.Errorf("giving up after %d attempts:\n%w", downloadAttempts, sourceErrors(sources, errs))
+}
+
+// tryDownload makes a single attempt to download source into partialPath and
+// checks the sha256 of the result. On failure it reports whether the source is
+// worth trying again.
+func tryDownload(ctx context.Context, source downloadSource, partialPath string, sha256 string) (retry bool, err error) {
+	if rt.Config.DebugMode {
+		log.Printf("Downloading %s from %s\n", partialPath, RedactURL(source.url))
+	}
+	resumed, retry, err := downloadAttempt(ctx, source.url, partialPath, source.auth)
+	if err != nil {
+		return retry, err
+	}
+	if tools.IsFileValid(partialPath, sha256) {
+		return false, nil
+	}
+
+	os.Remove(partialPath)
+	// a resumed download may have been stitched from two different files, so
+	// it is worth starting over from scratch
+	return resumed, fmt.Errorf("sha256 of the downloaded file does not match %s", sha256)
+}
+
+// sourceErrors joins the last error of every source, each with its URL.
+func sourceErrors(sources []downloadSource, errs []error) error {
+	joined := make([]error, len(sources))
+	for i, source := range sources {
+		joined[i] = fmt.Errorf("%s: %w", RedactURL(source.url), errs[i])
+	}
+	return errors.Join(joined...)
+}
+
+// downloadAttempt downloads url into partialPath, resuming the partial file when
+// there is one. It reports whether the download resumed and, on failure,
+// whether it is worth retrying.
+func downloadAttempt(ctx context.Context, url string, partialPath string, auth *obj.DownloadAuth) (resumed bool, retry bool, err error) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	var offset int64
+	if info, err := os.Stat(partialPath); err == nil {
+		offset = info.Size()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return false, false, fmt.Errorf("failed to download file: %s", err.Error())
+	}
+	// credentials that cannot be read will not be there on the next attempt either
+	if req, err = authorize(req, auth); err != nil {
+		return false, false, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := downloadClient.Do(req)
+	if err != nil {
+		return false, true, fmt.Errorf("failed to download file: %s", err.Error())
+	}
+	defer resp.Body.Close()
+
+	flags := os.O_CREATE | os.O_WRONLY
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+		if !strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", offset)) {
+			os.Remove(partialPath)
+			return false, true, fmt.Errorf("failed to resume download: unexpected range %q", resp.Header.Get("Content-Range"))
+		}
+		flags |= os.O_APPEND
+		resumed = true
+		if rt.Config.DebugMode {
+			log.Printf("Resuming download of %s at %d bytes\n", partialPath, offset)
+		}
+	case resp.StatusCode == http.StatusOK:
+		flags |= os.O_TRUNC
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0:
+		// the partial file is as long as the file already
+		return true, true, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return false, true, fmt.Errorf("failed to download file: %s", resp.Status)
+	default:
+		return false, false, fmt.Errorf("failed to download file: %s", resp.Status)
+	}
+
+	out, err := os.OpenFile(partialPath, flags, 0644)
+	if err != nil {
+		return resumed, false, fmt.Errorf("failed to create file: %s", err.Error())
+	}
+	defer out.Close()
+
+	watchdog := time.AfterFunc(downloadIdleTimeout, func() { cancel(errDownloadStalled) })
+	defer watchdog.Stop()
+	if _, err := io.Copy(out, &idleReader{r: resp.Body, watchdog: watchdog}); err != nil {
+		if context.Cause(ctx) == errDownloadStalled {
+			return resumed, true, fmt.Errorf("failed to copy file: no data received for %s", downloadIdleTimeout)
+		}
+		return resumed, true, fmt.Errorf("failed to copy file: %s", err.Error())
+	}
+
+	if rt.Config.DebugMode {
+		log.Printf("Downloaded file to: %s\n", partialPath)
+	}
+	return resumed, false, out.Close()
+}
+
+// idleReader restarts the watchdog of a download every time data arrives.
+type idleReader struct {
+	r        io.Reader
+	watchdog *time.Timer
+}
+
+func (i *idleReader) Read(p []byte) (int, error) {
+	n, err := i.r.Read(p)
+	if n > 0 {
+		i.watchdog.Reset(downloadIdleTimeout)
+	}
+	return n, err
+}
+
+// DownloadURLs returns the URLs the file of thirdParty for the current platform
+// is downloaded from, in the order they are tried, after the mirrors of every
+// config layer have been applied.
+func DownloadURLs(thirdParty obj.ThirdPartyConfig) []string {
+	var urls []string
+	for _, url := range thirdParty.URLs[rt.Config.Platform] {
+		for _, mirrored := range mirrorURLs(url) {
+			if !slices.Contains(urls, mirrored) {
+				urls = append(urls, mirrored)
+			}
+		}
+	}
+	return urls
+}
+
+// mirrorURLs rewrites url with the first mirror whose prefix matches it. The
+// mirrors of later config layers, such as a profile, are checked first.
+func mirrorURLs(url string) []string {
+	for i := len(rt.Config.Layers) - 1; i >= 0; i-- {
+		for _, mirror := range rt.Config.Layers[i].Overrides.Mirrors {
+			rest, ok := strings.CutPrefix(url, mirror.URLPrefix)
+			if !ok || mirror.URLPrefix == "" {
+				continue
+			}
+
+			var urls []string
+			for _, to := range mirror.RewriteTo {
+				urls = append(urls, to+rest)
+			}
+			if mirror.KeepOriginal {
+				urls = append(urls, url)
+			}
+			return urls
+		}
+	}
+	return []string{url}
+}
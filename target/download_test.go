@@ -0,0 +1,467 @@
+package target
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var testContent = bytes.Repeat([]byte("kamaji third party "), 512)
+
+func sha256Of(data []byte) string {
+	return fmt.Sprintf("%x", sha256.Sum256(data))
+}
+
+// fastRetries shortens the backoff between attempts for the duration of a test.
+func fastRetries(t *testing.T) {
+	attempts, backoff, maxBackoff, idle := downloadAttempts, downloadBackoff, maxDownloadBackoff, downloadIdleTimeout
+	downloadAttempts, downloadBackoff, maxDownloadBackoff = 5, time.Millisecond, time.Millisecond
+	t.Cleanup(func() {
+		downloadAttempts, downloadBackoff, maxDownloadBackoff, downloadIdleTimeout = attempts, backoff, maxBackoff, idle
+	})
+}
+
+// recorder serves the responses of a test in order and records the Range
+// header of every request. Requests past the last response get the last one.
+type recorder struct {
+	mu        sync.Mutex
+	ranges    []string
+	responses []http.HandlerFunc
+}
+
+func (rec *recorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rec.mu.Lock()
+	n := len(rec.ranges)
+	rec.ranges = append(rec.ranges, r.Header.Get("Range"))
+	respond := rec.responses[min(n, len(rec.responses)-1)]
+	rec.mu.Unlock()
+	respond(w, r)
+}
+
+func (rec *recorder) requests() []string {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return append([]string{}, rec.ranges...)
+}
+
+func status(code int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(code)
+	}
+}
+
+// full answers with the whole content, ignoring any Range header.
+func full(content []byte) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		w.WriteHeader(http.StatusOK)
+		w.Write(content)
+	}
+}
+
+// truncated announces the whole content but drops the connection halfway.
+func truncated(content []byte) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		w.WriteHeader(http.StatusOK)
+		w.Write(content[:len(content)/2])
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// ranged answers a Range request with the rest of content, announcing the range
+// as starting at reportedOffset.
+func ranged(content []byte, reportedOffset func(offset int) int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		offset, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(r.Header.Get("Range"), "bytes="), "-"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", reportedOffset(offset), len(content)-1, len(content)))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(content[offset:])
+	}
+}
+
+func sameOffset(offset int) int { return offset }
+
+type downloadFixture struct {
+	filePath    string
+	partialPath string
+}
+
+func newDownloadFixture(t *testing.T) downloadFixture {
+	filePath := filepath.Join(t.TempDir(), "file")
+	return downloadFixture{filePath: filePath, partialPath: filePath + ".partial"}
+}
+
+func (f downloadFixture) assertComplete(t *testing.T, want []byte) {
+	t.Helper()
+	got, err := os.ReadFile(f.filePath)
+	if err != nil {
+		t.Fatalf("cannot read the downloaded file: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("downloaded %d bytes, want %d bytes of the content", len(got), len(want))
+	}
+	if _, err := os.Stat(f.partialPath); !os.IsNotExist(err) {
+		t.Errorf("the partial file was left behind")
+	}
+}
+
+func (f downloadFixture) assertMissing(t *testing.T) {
+	t.Helper()
+	for _, path := range []string{f.filePath, f.partialPath} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s exists, want it removed", filepath.Base(path))
+		}
+	}
+}
+
+func assertRanges(t *testing.T, got []string, want ...string) {
+	t.Helper()
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("requests had Range headers %q, want %q", got, want)
+	}
+}
+
+func TestDownloadFileRetriesServerErrors(t *testing.T) {
+	fastRetries(t)
+	rec := &recorder{responses: []http.HandlerFunc{
+		status(http.StatusServiceUnavailable),
+		status(http.StatusTooManyRequests),
+		full(testContent),
+	}}
+	server := httptest.NewServer(rec)
+	defer server.Close()
+	f := newDownloadFixture(t)
+
+	if err := downloadFile(context.Background(), f.filePath, sha256Of(testContent), downloadSource{url: server.URL}); err != nil {
+		t.Fatalf("downloadFile() error = %v", err)
+	}
+	assertRanges(t, rec.requests(), "", "", "")
+	f.assertComplete(t, testContent)
+}
+
+func TestDownloadFileGivesUp(t *testing.T) {
+	fastRetries(t)
+	rec := &recorder{responses: []http.HandlerFunc{status(http.StatusBadGateway)}}
+	server := httptest.NewServer(rec)
+	defer server.Close()
+	f := newDownloadFixture(t)
+
+	err := downloadFile(context.Background(), f.filePath, sha256Of(testContent), downloadSource{url: server.URL})
+	if err == nil || !strings.Contains(err.Error(), "giving up after 5 attempts") {
+		t.Fatalf("downloadFile() error = %v, want giving up after 5 attempts", err)
+	}
+	if got := len(rec.requests()); got != downloadAttempts {
+		t.Errorf("made %d requests, want %d", got, downloadAttempts)
+	}
+	f.assertMissing(t)
+}
+
+func TestDownloadFileDoesNotRetryNotFound(t *testing.T) {
+	fastRetries(t)
+	rec := &recorder{responses: []http.HandlerFunc{status(http.StatusNotFound), full(testContent)}}
+	server := httptest.NewServer(rec)
+	defer server.Close()
+	f := newDownloadFixture(t)
+
+	err := downloadFile(context.Background(), f.filePath, sha256Of(testContent), downloadSource{url: server.URL})
+	if err == nil || !strings.Contains(err.Error(), "404") {
+		t.Fatalf("downloadFile() error = %v, want a 404 error", err)
+	}
+	assertRanges(t, rec.requests(), "")
+	f.assertMissing(t)
+}
+
+func TestDownloadFileResumes(t *testing.T) {
+	fastRetries(t)
+	rec := &recorder{responses: []http.HandlerFunc{truncated(testContent), ranged(testContent, sameOffset)}}
+	server := httptest.NewServer(rec)
+	defer server.Close()
+	f := newDownloadFixture(t)
+
+	if err := downloadFile(context.Background(), f.filePath, sha256Of(testContent), downloadSource{url: server.URL}); err != nil {
+		t.Fatalf("downloadFile() error = %v", err)
+	}
+	assertRanges(t, rec.requests(), "", fmt.Sprintf("bytes=%d-", len(testContent)/2))
+	f.assertComplete(t, testContent)
+}
+
+func TestDownloadFileRestartsOnUnexpectedContentRange(t *testing.T) {
+	fastRetries(t)
+	rec := &recorder{responses: []http.HandlerFunc{
+		truncated(testContent),
+		ranged(testContent, func(offset int) int { return offset - 1 }),
+		full(testContent),
+	}}
+	server := httptest.NewServer(rec)
+	defer server.Close()
+	f := newDownloadFixture(t)
+
+	if err := downloadFile(context.Background(), f.filePath, sha256Of(testContent), downloadSource{url: server.URL}); err != nil {
+		t.Fatalf("downloadFile() error = %v", err)
+	}
+	assertRanges(t, rec.requests(), "", fmt.Sprintf("bytes=%d-", len(testContent)/2), "")
+	f.assertComplete(t, testContent)
+}
+
+func TestDownloadFileTruncatesWhenRangeIsIgnored(t *testing.T) {
+	fastRetries(t)
+	rec := &recorder{responses: []http.HandlerFunc{full(testContent)}}
+	server := httptest.NewServer(rec)
+	defer server.Close()
+	f := newDownloadFixture(t)
+	if err := os.WriteFile(f.partialPath, []byte("left over from another download"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := downloadFile(context.Background(), f.filePath, sha256Of(testContent), downloadSource{url: server.URL}); err != nil {
+		t.Fatalf("downloadFile() error = %v", err)
+	}
+	assertRanges(t, rec.requests(), "bytes=31-")
+	f.assertComplete(t, testContent)
+}
+
+func TestDownloadFileCompletePartial(t *testing.T) {
+	fastRetries(t)
+	rec := &recorder{responses: []http.HandlerFunc{status(http.StatusRequestedRangeNotSatisfiable)}}
+	server := httptest.NewServer(rec)
+	defer server.Close()
+	f := newDownloadFixture(t)
+	if err := os.WriteFile(f.partialPath, testContent, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := downloadFile(context.Background(), f.filePath, sha256Of(testContent), downloadSource{url: server.URL}); err != nil {
+		t.Fatalf("downloadFile() error = %v", err)
+	}
+	assertRanges(t, rec.requests(), fmt.Sprintf("bytes=%d-", len(testContent)))
+	f.assertComplete(t, testContent)
+}
+
+func TestDownloadFileSHA256Mismatch(t *testing.T) {
+	fastRetries(t)
+	rec := &recorder{responses: []http.HandlerFunc{full([]byte("not the file")), full(testContent)}}
+	server := httptest.NewServer(rec)
+	defer server.Close()
+	f := newDownloadFixture(t)
+
+	err := downloadFile(context.Background(), f.filePath, sha256Of(testContent), downloadSource{url: server.URL})
+	if err == nil || !strings.Contains(err.Error(), "sha256") {
+		t.Fatalf("downloadFile() error = %v, want a sha256 mismatch", err)
+	}
+	// a complete download with the wrong content is not worth retrying
+	assertRanges(t, rec.requests(), "")
+	f.assertMissing(t)
+}
+
+func TestDownloadFileRestartsResumedMismatch(t *testing.T) {
+	fastRetries(t)
+	rec := &recorder{responses: []http.HandlerFunc{ranged(testContent, sameOffset), full(testContent)}}
+	server := httptest.NewServer(rec)
+	defer server.Close()
+	f := newDownloadFixture(t)
+	// the first half of a different file, so the resumed download is stitched
+	// from two files
+	stale := bytes.Repeat([]byte("x"), len(testContent)/2)
+	if err := os.WriteFile(f.partialPath, stale, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := downloadFile(context.Background(), f.filePath, sha256Of(testContent), downloadSource{url: server.URL}); err != nil {
+		t.Fatalf("downloadFile() error = %v", err)
+	}
+	assertRanges(t, rec.requests(), fmt.Sprintf("bytes=%d-", len(stale)), "")
+	f.assertComplete(t, testContent)
+}
+
+func TestDownloadFileRetriesStalledBody(t *testing.T) {
+	fastRetries(t)
+	downloadIdleTimeout = 100 * time.Millisecond
+	stalled := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(testContent)))
+		w.WriteHeader(http.StatusOK)
+		w.Write(testContent[:len(testContent)/2])
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}
+	rec := &recorder{responses: []http.HandlerFunc{stalled, ranged(testContent, sameOffset)}}
+	server := httptest.NewServer(rec)
+	defer server.Close()
+	f := newDownloadFixture(t)
+
+	if err := downloadFile(context.Background(), f.filePath, sha256Of(testContent), downloadSource{url: server.URL}); err != nil {
+		t.Fatalf("downloadFile() error = %v", err)
+	}
+	assertRanges(t, rec.requests(), "", fmt.Sprintf("bytes=%d-", len(testContent)/2))
+	f.assertComplete(t, testContent)
+}
+
+func TestDownloadFileCancelledDuringBackoff(t *testing.T) {
+	fastRetries(t)
+	downloadBackoff, maxDownloadBackoff = time.Hour, time.Hour
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	interrupted := errors.New("interrupted")
+
+	rec := &recorder{responses: []http.HandlerFunc{func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			cancel(interrupted)
+		}()
+	}}}
+	server := httptest.NewServer(rec)
+	defer server.Close()
+	f := newDownloadFixture(t)
+
+	start := time.Now()
+	err := downloadFile(ctx, f.filePath, sha256Of(testContent), downloadSource{url: server.URL})
+	if !errors.Is(err, interrupted) {
+		t.Fatalf("downloadFile() error = %v, want the cancellation cause", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("downloadFile() returned after %s, want it to stop waiting when cancelled", elapsed)
+	}
+	assertRanges(t, rec.requests(), "")
+	f.assertMissing(t)
+}
+
+// unreachableURL returns the URL of a server that has been shut down, so
+// connections to it are refused.
+func unreachableURL() string {
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+	return server.URL
+}
+
+func TestDownloadFileFallsBackWithoutBackoff(t *testing.T) {
+	fastRetries(t)
+	downloadBackoff, maxDownloadBackoff = time.Hour, time.Hour
+	rec := &recorder{responses: []http.HandlerFunc{full(testContent)}}
+	server := httptest.NewServer(rec)
+	defer server.Close()
+	f := newDownloadFixture(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err := downloadFile(ctx, f.filePath, sha256Of(testContent), downloadSource{url: unreachableURL()}, downloadSource{url: server.URL})
+	if err != nil {
+		t.Fatalf("downloadFile() error = %v", err)
+	}
+	assertRanges(t, rec.requests(), "")
+	f.assertComplete(t, testContent)
+}
+
+func TestDownloadFileBacksOffAfterEveryURL(t *testing.T) {
+	fastRetries(t)
+	first := &recorder{responses: []http.HandlerFunc{status(http.StatusServiceUnavailable)}}
+	second := &recorder{responses: []http.HandlerFunc{status(http.StatusBadGateway), full(testContent)}}
+	firstServer, secondServer := httptest.NewServer(first), httptest.NewServer(second)
+	defer firstServer.Close()
+	defer secondServer.Close()
+	f := newDownloadFixture(t)
+
+	err := downloadFile(context.Background(), f.filePath, sha256Of(testContent), downloadSource{url: firstServer.URL}, downloadSource{url: secondServer.URL})
+	if err != nil {
+		t.Fatalf("downloadFile() error = %v", err)
+	}
+	// every round tries the first URL again before the second one
+	assertRanges(t, first.requests(), "", "")
+	assertRanges(t, second.requests(), "", "")
+	f.assertComplete(t, testContent)
+}
+
+func TestDownloadFileDropsURLsThatFailForGood(t *testing.T) {
+	fastRetries(t)
+	first := &recorder{responses: []http.HandlerFunc{status(http.StatusNotFound)}}
+	second := &recorder{responses: []http.HandlerFunc{status(http.StatusServiceUnavailable), full(testContent)}}
+	firstServer, secondServer := httptest.NewServer(first), httptest.NewServer(second)
+	defer firstServer.Close()
+	defer secondServer.Close()
+	f := newDownloadFixture(t)
+
+	err := downloadFile(context.Background(), f.filePath, sha256Of(testContent), downloadSource{url: firstServer.URL}, downloadSource{url: secondServer.URL})
+	if err != nil {
+		t.Fatalf("downloadFile() error = %v", err)
+	}
+	assertRanges(t, first.requests(), "")
+	assertRanges(t, second.requests(), "", "")
+	f.assertComplete(t, testContent)
+}
+
+func TestDownloadFileResumesFromAnotherURL(t *testing.T) {
+	fastRetries(t)
+	first := &recorder{responses: []http.HandlerFunc{truncated(testContent)}}
+	second := &recorder{responses: []http.HandlerFunc{ranged(testContent, sameOffset)}}
+	firstServer, secondServer := httptest.NewServer(first), httptest.NewServer(second)
+	defer firstServer.Close()
+	defer secondServer.Close()
+	f := newDownloadFixture(t)
+
+	err := downloadFile(context.Background(), f.filePath, sha256Of(testContent), downloadSource{url: firstServer.URL}, downloadSource{url: secondServer.URL})
+	if err != nil {
+		t.Fatalf("downloadFile() error = %v", err)
+	}
+	assertRanges(t, first.requests(), "")
+	assertRanges(t, second.requests(), fmt.Sprintf("bytes=%d-", len(testContent)/2))
+	f.assertComplete(t, testContent)
+}
+
+func TestDownloadFileEveryURLFails(t *testing.T) {
+	fastRetries(t)
+	notFound := &recorder{responses: []http.HandlerFunc{status(http.StatusNotFound)}}
+	unavailable := &recorder{responses: []http.HandlerFunc{status(http.StatusServiceUnavailable)}}
+	notFoundServer, unavailableServer := httptest.NewServer(notFound), httptest.NewServer(unavailable)
+	defer notFoundServer.Close()
+	defer unavailableServer.Close()
+
+	tests := []struct {
+		name    string
+		sources []downloadSource
+		want    []string
+	}{
+		{
+			name:    "for good",
+			sources: []downloadSource{{url: notFoundServer.URL}, {url: notFoundServer.URL + "/other"}},
+			want:    []string{"every URL failed:\n", notFoundServer.URL + ": failed to download file: 404", notFoundServer.URL + "/other: failed to download file: 404"},
+		},
+		{
+			name:    "after every attempt",
+			sources: []downloadSource{{url: notFoundServer.URL}, {url: unavailableServer.URL}},
+			want:    []string{"giving up after 5 attempts:\n", notFoundServer.URL + ": failed to download file: 404", unavailableServer.URL + ": failed to download file: 503"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newDownloadFixture(t)
+			err := downloadFile(context.Background(), f.filePath, sha256Of(testContent), tt.sources...)
+			if err == nil {
+				t.Fatalf("downloadFile() error = nil, want every URL to fail")
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("downloadFile() error = %q, want it to contain %q", err.Error(), want)
+				}
+			}
+			f.assertMissing(t)
+		})
+	}
+}
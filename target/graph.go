@@ -0,0 +1,131 @@
+package target
+
+import (
+	"fmt"
+	"kamaji/label"
+	"kamaji/obj"
+	"path/filepath"
+	"strings"
+)
+
+// Graph holds the requested targets together with everything they depend on.
+// Order lists the keys of Targets so that every target comes after its deps.
+type Graph struct {
+	Targets map[string]obj.ExecTarget
+	Deps    map[string][]string
+	Order   []string
+}
+
+// Key identifies a target across build files.
+func Key(target obj.ExecTarget) string {
+	return target.BuildFile + ":" + target.Name
+}
+
+// BuildGraph loads the dependencies of roots recursively, in the same build file
+// or in others, and orders them topologically. A dependency cycle is an error.
+func BuildGraph(roots []obj.ExecTarget) (*Graph, error) {
+	g := &Graph{
+		Targets: make(map[string]obj.ExecTarget),
+		Deps:    make(map[string][]string),
+	}
+	loader := newBuildFileLoader()
+
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := make(map[string]int)
+
+	var visit func(target obj.ExecTarget, path []string) error
+	visit = func(target obj.ExecTarget, path []string) error {
+		key := Key(target)
+		path = append(path, target.Label)
+
+		switch state[key] {
+		case visiting:
+			return fmt.Errorf("dependency cycle: %s", strings.Join(path, " -> "))
+		case visited:
+			return nil
+		}
+		state[key] = visiting
+		g.Targets[key] = target
+
+		for _, ref := range target.Deps {
+			dep, err := loader.resolveDep(target, ref)
+			if err != nil {
+				return err
+			}
+			if err := visit(dep, path); err != nil {
+				return err
+			}
+			g.Deps[key] = append(g.Deps[key], Key(dep))
+		}
+
+		state[key] = visited
+		g.Order = append(g.Order, key)
+		return nil
+	}
+
+	for _, root := range roots {
+		if err := visit(root, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	return g, nil
+}
+
+// buildFileLoader loads every build file at most once while a graph is built.
+type buildFileLoader struct {
+	files map[string]obj.BuildFile
+}
+
+func newBuildFileLoader() *buildFileLoader {
+	return &buildFileLoader{files: make(map[string]obj.BuildFile)}
+}
+
+func (l *buildFileLoader) findTarget(buildFileName string, name string) (obj.ExecTarget, error) {
+	buildFile, ok := l.files[buildFileName]
+	if !ok {
+		var err error
+		buildFile, err = LoadBuildFile(buildFileName)
+		if err != nil {
+			return obj.ExecTarget{}, err
+		}
+		l.files[buildFileName] = buildFile
+	}
+
+	for _, target := range buildFile.Targets {
+		if target.Name == name {
+			return target, nil
+		}
+	}
+	return obj.ExecTarget{}, fmt.Errorf("target %s not found in %s", name, buildFileName)
+}
+
+// resolveDep finds the target a dependency reference of from points to. The
+// reference is a label relative to the package of from, so a bare name refers to
+// a target of the same build file. The build file of another package has the
+// same base name as the one of from.
+func (l *buildFileLoader) resolveDep(from obj.ExecTarget, ref string) (obj.ExecTarget, error) {
+	pkg, err := label.PackageOf(from.Dir)
+	if err != nil {
+		return obj.ExecTarget{}, fmt.Errorf("dependency %q of target %s: %s", ref, from.Label, err.Error())
+	}
+
+	depLabel, err := label.Parse(ref, pkg)
+	if err != nil {
+		return obj.ExecTarget{}, fmt.Errorf("invalid dependency of target %s: %s", from.Label, err.Error())
+	}
+
+	buildFileName := label.BuildFile(depLabel, filepath.Base(from.BuildFile))
+	if depLabel.Package == pkg {
+		buildFileName = from.BuildFile
+	}
+
+	dep, err := l.findTarget(buildFileName, depLabel.Name)
+	if err != nil {
+		return obj.ExecTarget{}, fmt.Errorf("dependency %q of target %s: %s", ref, from.Label, err.Error())
+	}
+	return dep, nil
+}
@@ -0,0 +1,156 @@
+package target
+
+import (
+	"kamaji/obj"
+	"kamaji/rt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// writeWorkspace writes the build files of a test workspace, keyed by their
+// path relative to the workspace root, and makes it the current workspace.
+func writeWorkspace(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for path, content := range files {
+		path = filepath.Join(dir, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	workspaceDir := rt.Config.WorkspaceDir
+	rt.Config.WorkspaceDir = dir
+	t.Cleanup(func() { rt.Config.WorkspaceDir = workspaceDir })
+	return dir
+}
+
+func TestBuildGraph(t *testing.T) {
+	tests := []struct {
+		name    string
+		files   map[string]string
+		root    string
+		want    []string
+		wantErr string
+	}{
+		{
+			name: "deps come first",
+			files: map[string]string{"BUILD.yaml": `
+targets:
+  - {name: a, rule: r/r.py, deps: [b, c]}
+  - {name: b, rule: r/r.py, deps: [":c"]}
+  - {name: c, rule: r/r.py}
+`},
+			root: "a",
+			want: []string{"//:c", "//:b", "//:a"},
+		},
+		{
+			name: "deps in other packages",
+			files: map[string]string{
+				"BUILD.yaml": `
+targets:
+  - {name: app, rule: r/r.py, deps: ["//infra:network", "infra/db:schema"]}
+`,
+				"infra/BUILD.yaml": `
+targets:
+  - {name: network, rule: r/r.py}
+`,
+				"infra/db/BUILD.yaml": `
+targets:
+  - {name: schema, rule: r/r.py, deps: ["..:network"]}
+`,
+			},
+			root: "app",
+			want: []string{"//infra:network", "//infra/db:schema", "//:app"},
+		},
+		{
+			name: "self dependency",
+			files: map[string]string{"BUILD.yaml": `
+targets:
+  - {name: a, rule: r/r.py, deps: [a]}
+`},
+			root:    "a",
+			wantErr: "dependency cycle: //:a -> //:a",
+		},
+		{
+			name: "cycle",
+			files: map[string]string{"BUILD.yaml": `
+targets:
+  - {name: a, rule: r/r.py, deps: [b]}
+  - {name: b, rule: r/r.py, deps: [c]}
+  - {name: c, rule: r/r.py, deps: [a]}
+`},
+			root:    "a",
+			wantErr: "dependency cycle: //:a -> //:b -> //:c -> //:a",
+		},
+		{
+			name: "cycle across packages",
+			files: map[string]string{
+				"BUILD.yaml": `
+targets:
+  - {name: a, rule: r/r.py, deps: ["//infra:b"]}
+`,
+				"infra/BUILD.yaml": `
+targets:
+  - {name: b, rule: r/r.py, deps: ["//:a"]}
+`,
+			},
+			root:    "a",
+			wantErr: "dependency cycle: //:a -> //infra:b -> //:a",
+		},
+		{
+			name: "cycle below the root",
+			files: map[string]string{"BUILD.yaml": `
+targets:
+  - {name: a, rule: r/r.py, deps: [b]}
+  - {name: b, rule: r/r.py, deps: [c]}
+  - {name: c, rule: r/r.py, deps: [b]}
+`},
+			root:    "a",
+			wantErr: "dependency cycle: //:a -> //:b -> //:c -> //:b",
+		},
+		{
+			name: "missing dependency",
+			files: map[string]string{"BUILD.yaml": `
+targets:
+  - {name: a, rule: r/r.py, deps: [nope]}
+`},
+			root:    "a",
+			wantErr: `dependency "nope" of target //:a: target nope not found in `,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := writeWorkspace(t, tt.files)
+			root, err := ParseBuildFile(filepath.Join(dir, "BUILD.yaml"), tt.root)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			graph, err := BuildGraph([]obj.ExecTarget{root})
+			if tt.wantErr != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), tt.wantErr) {
+					t.Fatalf("BuildGraph() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("BuildGraph() error = %v", err)
+			}
+
+			var order []string
+			for _, key := range graph.Order {
+				order = append(order, graph.Targets[key].Label)
+			}
+			if !slices.Equal(order, tt.want) {
+				t.Errorf("BuildGraph() order = %q, want %q", order, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,242 @@
+package target
+
+import (
+	"fmt"
+	"kamaji/obj"
+	"kamaji/rt"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// A target is merged from layers, from lowest to highest precedence:
+//
+//  1. the defaults of the included fragments, in include order
+//  2. the defaults of the build file itself
+//  3. the templates it extends, the base template first
+//  4. the target itself
+//
+// rule, description and timeout of a later layer replace earlier ones, tags and
+// deps are appended without duplicates, and config is merged key by key: maps
+// are merged recursively, any other value replaces the earlier one and null
+// removes it.
+
+// layer is a partial target merged into a target, together with where it comes from.
+type layer struct {
+	target obj.ExecTarget
+	origin string
+}
+
+// fragmentSet collects the defaults and templates of a build file and of the
+// fragments it includes. Every fragment is read once, even when it is included
+// several times.
+type fragmentSet struct {
+	defaults  []layer
+	templates map[string]layer
+	loaded    map[string]bool
+	including []string
+}
+
+// expandBuildFile merges the defaults and templates into every target of the
+// build file at path.
+func expandBuildFile(buildFile *obj.BuildFile, path string) error {
+	set := &fragmentSet{
+		templates: make(map[string]layer),
+		loaded:    map[string]bool{path: true},
+		including: []string{path},
+	}
+	if err := set.add(*buildFile, path); err != nil {
+		return err
+	}
+	for fragment := range set.loaded {
+		if fragment != path {
+			buildFile.Fragments = append(buildFile.Fragments, fragment)
+		}
+	}
+	slices.Sort(buildFile.Fragments)
+
+	for i, target := range buildFile.Targets {
+		chain, err := set.templateChain(target)
+		if err != nil {
+			return err
+		}
+
+		layers := slices.Concat(set.defaults, chain, []layer{{target: target, origin: workspacePath(path) + " target " + target.Name}})
+		merged := obj.ExecTarget{
+			Name:    target.Name,
+			Extends: target.Extends,
+			Origins: make(map[string]string),
+		}
+		for _, l := range layers {
+			mergeLayer(&merged, l)
+		}
+		buildFile.Targets[i] = merged
+	}
+
+	return nil
+}
+
+func (s *fragmentSet) add(file obj.BuildFile, path string) error {
+	for _, include := range file.Include {
+		if !strings.HasPrefix(include, "//") {
+			return fmt.Errorf("include %q of %s must start with //", include, workspacePath(path))
+		}
+
+		fragmentPath := filepath.Join(rt.Config.WorkspaceDir, include[2:])
+		if slices.Contains(s.including, fragmentPath) {
+			var cycle []string
+			for _, p := range append(s.including, fragmentPath) {
+				cycle = append(cycle, workspacePath(p))
+			}
+			return fmt.Errorf("include cycle: %s", strings.Join(cycle, " -> "))
+		}
+		if s.loaded[fragmentPath] {
+			continue
+		}
+		s.loaded[fragmentPath] = true
+
+		fragment, err := readFragment(fragmentPath)
+		if err != nil {
+			return err
+		}
+
+		s.including = append(s.including, fragmentPath)
+		err = s.add(fragment, fragmentPath)
+		s.including = s.including[:len(s.including)-1]
+		if err != nil {
+			return err
+		}
+	}
+
+	if !reflect.ValueOf(file.Defaults).IsZero() {
+		if file.Defaults.Name != "" || file.Defaults.Extends != "" {
+			return fmt.Errorf("defaults of %s cannot have a name or extend a template", workspacePath(path))
+		}
+		s.defaults = append(s.defaults, layer{target: file.Defaults, origin: workspacePath(path) + " defaults"})
+	}
+
+	for _, template := range file.Templates {
+		if template.Name == "" {
+			return fmt.Errorf("template without a name in %s", workspacePath(path))
+		}
+		if existing, ok := s.templates[template.Name]; ok {
+			return fmt.Errorf("template %s is defined twice: %s and %s", template.Name, existing.origin, workspacePath(path))
+		}
+		s.templates[template.Name] = layer{target: template, origin: workspacePath(path) + " template " + template.Name}
+	}
+
+	return nil
+}
+
+// templateChain returns the templates target extends, directly or through
+// other templates, with the base template first.
+func (s *fragmentSet) templateChain(target obj.ExecTarget) ([]layer, error) {
+	var chain []layer
+	seen := []string{}
+	for name := target.Extends; name != ""; {
+		if slices.Contains(seen, name) {
+			return nil, fmt.Errorf("target %s: template cycle: %s -> %s", target.Name, strings.Join(seen, " -> "), name)
+		}
+		seen = append(seen, name)
+
+		template, ok := s.templates[name]
+		if !ok {
+			return nil, fmt.Errorf("target %s extends unknown template %s", target.Name, name)
+		}
+		chain = append([]layer{template}, chain...)
+		name = template.target.Extends
+	}
+	return chain, nil
+}
+
+func readFragment(path string) (obj.BuildFile, error) {
+	if rt.Config.DebugMode {
+		log.Printf("Including fragment: %s\n", path)
+	}
+
+	var fragment obj.BuildFile
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fragment, err
+	}
+	if err := yaml.Unmarshal(data, &fragment); err != nil {
+		return fragment, fmt.Errorf("failed to parse %s: %s", path, err.Error())
+	}
+	if len(fragment.Targets) > 0 {
+		return fragment, fmt.Errorf("%s is included and cannot define targets", workspacePath(path))
+	}
+	return fragment, nil
+}
+
+func mergeLayer(dst *obj.ExecTarget, l layer) {
+	src := l.target
+	if src.Rule != "" {
+		dst.Rule = src.Rule
+		dst.Origins["rule"] = l.origin
+	}
+	if src.Description != "" {
+		dst.Description = src.Description
+		dst.Origins["description"] = l.origin
+	}
+	if src.Timeout != "" {
+		dst.Timeout = src.Timeout
+		dst.Origins["timeout"] = l.origin
+	}
+	dst.Tags = appendUnique(dst.Tags, src.Tags...)
+	dst.Deps = appendUnique(dst.Deps, src.Deps...)
+
+	for key, value := range src.Config {
+		if value == nil {
+			delete(dst.Config, key)
+			delete(dst.Origins, "config."+key)
+			continue
+		}
+		if dst.Config == nil {
+			dst.Config = make(map[string]any)
+		}
+		dst.Config[key] = mergeValue(dst.Config[key], value)
+		dst.Origins["config."+key] = l.origin
+	}
+}
+
+// mergeValue merges override into base when both are maps and returns override
+// otherwise. Neither of them is modified, as templates are shared by targets.
+func mergeValue(base any, override any) any {
+	baseMap, baseOk := toStringMap(base)
+	overrideMap, overrideOk := toStringMap(override)
+	if !baseOk || !overrideOk {
+		return override
+	}
+
+	for key, value := range overrideMap {
+		if value == nil {
+			delete(baseMap, key)
+			continue
+		}
+		baseMap[key] = mergeValue(baseMap[key], value)
+	}
+	return baseMap
+}
+
+func appendUnique(values []string, more ...string) []string {
+	for _, value := range more {
+		if !slices.Contains(values, value) {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// workspacePath returns path as a // path when it is inside the workspace.
+func workspacePath(path string) string {
+	rel, err := filepath.Rel(rt.Config.WorkspaceDir, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return path
+	}
+	return "//" + filepath.ToSlash(rel)
+}
@@ -0,0 +1,230 @@
+package target
+
+import (
+	"fmt"
+	"kamaji/obj"
+	"kamaji/rt"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// referencePattern matches ${scope.name} references. $${...} escapes a reference
+// and stands for the literal ${...}.
+var referencePattern = regexp.MustCompile(`\$(\$?)\{([^}]*)\}`)
+
+// interpolator expands the references in the config of a target. Config keys
+// are expanded at most once, and keys that are being expanded are tracked to
+// detect references that form a cycle. A key that failed keeps its error, so a
+// cycle is reported once rather than for every key in it.
+type interpolator struct {
+	target    *obj.ExecTarget
+	specs     map[string]obj.VariableSpec
+	expanded  map[string]any
+	failed    map[string]error
+	resolving []string
+}
+
+// interpolateConfig expands ${workspace.name}, ${env.NAME}, ${target.field} and
+// ${config.key} references in every string of the target config. A string made
+// of a single reference takes the value it refers to, so a config reference can
+// copy a list or a map. References to config keys the target does not set fall
+// back to the default of the rule definition. Every reference that cannot be
+// resolved is reported.
+func interpolateConfig(target *obj.ExecTarget, specs map[string]obj.VariableSpec) []error {
+	in := &interpolator{
+		target:   target,
+		specs:    specs,
+		expanded: make(map[string]any),
+		failed:   make(map[string]error),
+	}
+
+	keys := make([]string, 0, len(target.Config))
+	for key := range target.Config {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var problems []error
+	reported := make(map[string]bool)
+	config := make(map[string]any, len(target.Config))
+	for _, key := range keys {
+		value, err := in.expandKey(key)
+		if err != nil {
+			// keys referring to a broken key fail with the same error
+			if !reported[err.Error()] {
+				reported[err.Error()] = true
+				problems = append(problems, err)
+			}
+			continue
+		}
+		config[key] = value
+	}
+	if len(problems) == 0 {
+		target.Config = config
+	}
+	return problems
+}
+
+func (in *interpolator) expandKey(key string) (any, error) {
+	if value, ok := in.expanded[key]; ok {
+		return value, nil
+	}
+	if err, ok := in.failed[key]; ok {
+		return nil, err
+	}
+	if slices.Contains(in.resolving, key) {
+		return nil, fmt.Errorf("variable '%s' refers to itself: %s -> %s", in.resolving[0], strings.Join(in.resolving, " -> "), key)
+	}
+
+	value, ok := in.target.Config[key]
+	if !ok {
+		value = in.specs[key].Default
+	}
+
+	in.resolving = append(in.resolving, key)
+	value, err := in.expandValue(key, value)
+	in.resolving = in.resolving[:len(in.resolving)-1]
+	if err != nil {
+		in.failed[key] = err
+		return nil, err
+	}
+
+	in.expanded[key] = value
+	return value, nil
+}
+
+func (in *interpolator) expandValue(path string, value any) (any, error) {
+	switch v := value.(type) {
+	case string:
+		return in.expandString(path, v)
+	case map[string]any, map[any]any:
+		fields, _ := toStringMap(v)
+		for key, item := range fields {
+			expanded, err := in.expandValue(path+"."+key, item)
+			if err != nil {
+				return nil, err
+			}
+			fields[key] = expanded
+		}
+		return fields, nil
+	case []any:
+		items := make([]any, len(v))
+		for i, item := range v {
+			expanded, err := in.expandValue(fmt.Sprintf("%s[%d]", path, i), item)
+			if err != nil {
+				return nil, err
+			}
+			items[i] = expanded
+		}
+		return items, nil
+	default:
+		return v, nil
+	}
+}
+
+func (in *interpolator) expandString(path string, s string) (any, error) {
+	matches := referencePattern.FindAllStringSubmatchIndex(s, -1)
+	if len(matches) == 0 {
+		return s, nil
+	}
+
+	// a string that is a single reference keeps the type of the value
+	if len(matches) == 1 && matches[0][0] == 0 && matches[0][1] == len(s) && matches[0][2] == matches[0][3] {
+		return in.resolve(path, s[matches[0][4]:matches[0][5]])
+	}
+
+	var result strings.Builder
+	last := 0
+	for _, m := range matches {
+		result.WriteString(s[last:m[0]])
+		last = m[1]
+
+		reference := s[m[4]:m[5]]
+		if m[2] != m[3] {
+			result.WriteString("${" + reference + "}")
+			continue
+		}
+
+		value, err := in.resolve(path, reference)
+		if err != nil {
+			return nil, err
+		}
+		switch value.(type) {
+		case map[string]any, []any:
+			return nil, fmt.Errorf("variable '%s': ${%s} is a %s and cannot be part of a string", path, reference, determineVariableType(value))
+		}
+		fmt.Fprint(&result, value)
+	}
+	result.WriteString(s[last:])
+
+	return result.String(), nil
+}
+
+// resolve returns the value a reference such as "env.USER" stands for.
+func (in *interpolator) resolve(path string, reference string) (any, error) {
+	unresolved := func(reason string) error {
+		return fmt.Errorf("variable '%s': cannot resolve ${%s}: %s", path, reference, reason)
+	}
+
+	scope, name, _ := strings.Cut(reference, ".")
+	if name == "" {
+		return nil, unresolved("expected ${scope.name}")
+	}
+
+	switch scope {
+	case "workspace":
+		value, ok := rt.Config.WorkspaceConfig.WorkspaceVars[name]
+		if !ok {
+			return nil, unresolved("no such workspace variable")
+		}
+		return value, nil
+
+	case "env":
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return nil, unresolved("environment variable is not set")
+		}
+		return value, nil
+
+	case "target":
+		switch name {
+		case "name":
+			return in.target.Name, nil
+		case "label":
+			return in.target.Label, nil
+		case "dir":
+			return in.target.Dir, nil
+		case "rule":
+			return in.target.Rule, nil
+		}
+		return nil, unresolved("the target has no such field, use name, label, dir or rule")
+
+	case "config":
+		key, rest, _ := strings.Cut(name, ".")
+		if _, ok := in.target.Config[key]; !ok && in.specs[key].Default == nil {
+			return nil, unresolved(fmt.Sprintf("config key '%s' is not set", key))
+		}
+		value, err := in.expandKey(key)
+		if err != nil {
+			return nil, err
+		}
+		for rest != "" {
+			var field string
+			field, rest, _ = strings.Cut(rest, ".")
+			fields, ok := toStringMap(value)
+			if !ok {
+				return nil, unresolved(fmt.Sprintf("'%s' is not a map", key))
+			}
+			if value, ok = fields[field]; !ok {
+				return nil, unresolved(fmt.Sprintf("'%s' has no field '%s'", key, field))
+			}
+			key += "." + field
+		}
+		return value, nil
+	}
+
+	return nil, unresolved(fmt.Sprintf("unknown scope '%s', use workspace, env, target or config", scope))
+}
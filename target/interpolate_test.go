@@ -0,0 +1,178 @@
+package target
+
+import (
+	"errors"
+	"kamaji/obj"
+	"kamaji/rt"
+	"reflect"
+	"testing"
+)
+
+func TestInterpolateConfig(t *testing.T) {
+	rt.Config.WorkspaceConfig.WorkspaceVars = obj.WorkspaceVars{"region": "eu-west-1"}
+	t.Setenv("KAMAJI_TEST_USER", "alice")
+
+	tests := []struct {
+		name   string
+		config map[string]any
+		specs  map[string]obj.VariableSpec
+		want   map[string]any
+	}{
+		{
+			name:   "scopes",
+			config: map[string]any{"msg": "${target.name} in ${workspace.region} by ${env.KAMAJI_TEST_USER}"},
+			want:   map[string]any{"msg": "plan in eu-west-1 by alice"},
+		},
+		{
+			name:   "escaped references are kept literally",
+			config: map[string]any{"a": "$${env.HOME}/x", "b": "$${target.name}-${target.name}", "c": "$$5 and $HOME"},
+			want:   map[string]any{"a": "${env.HOME}/x", "b": "${target.name}-plan", "c": "$$5 and $HOME"},
+		},
+		{
+			name: "a single reference keeps the type of the value",
+			config: map[string]any{
+				"zones":   []any{"a", "b"},
+				"count":   3,
+				"enabled": true,
+				"tags":    map[any]any{"team": "infra"},
+				"z":       "${config.zones}",
+				"n":       "${config.count}",
+				"e":       "${config.enabled}",
+				"t":       "${config.tags}",
+			},
+			want: map[string]any{
+				"zones":   []any{"a", "b"},
+				"count":   3,
+				"enabled": true,
+				"tags":    map[string]any{"team": "infra"},
+				"z":       []any{"a", "b"},
+				"n":       3,
+				"e":       true,
+				"t":       map[string]any{"team": "infra"},
+			},
+		},
+		{
+			name:   "references inside a string are formatted",
+			config: map[string]any{"count": 3, "msg": "count=${config.count}"},
+			want:   map[string]any{"count": 3, "msg": "count=3"},
+		},
+		{
+			name: "field paths",
+			config: map[string]any{
+				"db":  map[any]any{"host": "db.local", "port": 5432, "tls": map[any]any{"mode": "strict"}},
+				"url": "${config.db.host}:${config.db.port}",
+				"tls": "${config.db.tls.mode}",
+			},
+			want: map[string]any{
+				"db":  map[string]any{"host": "db.local", "port": 5432, "tls": map[string]any{"mode": "strict"}},
+				"url": "db.local:5432",
+				"tls": "strict",
+			},
+		},
+		{
+			name:   "references in nested values",
+			config: map[string]any{"args": []any{"--name=${target.name}", map[any]any{"user": "${env.KAMAJI_TEST_USER}"}}},
+			want:   map[string]any{"args": []any{"--name=plan", map[string]any{"user": "alice"}}},
+		},
+		{
+			name:   "chained references",
+			config: map[string]any{"a": "${config.b}/a", "b": "${config.c}/b", "c": "c"},
+			want:   map[string]any{"a": "c/b/a", "b": "c/b", "c": "c"},
+		},
+		{
+			name:   "defaults of keys that are not set",
+			config: map[string]any{"path": "/tmp/${config.state}"},
+			specs:  map[string]obj.VariableSpec{"state": {Type: "string", Default: "${target.name}.tfstate"}},
+			want:   map[string]any{"path": "/tmp/plan.tfstate"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := &obj.ExecTarget{Name: "plan", Config: tt.config}
+			if problems := interpolateConfig(target, tt.specs); len(problems) > 0 {
+				t.Fatalf("interpolateConfig() problems = %v", errors.Join(problems...))
+			}
+			if !reflect.DeepEqual(target.Config, tt.want) {
+				t.Errorf("interpolateConfig() =\n%#v\nwant\n%#v", target.Config, tt.want)
+			}
+		})
+	}
+}
+
+func TestInterpolateConfigProblems(t *testing.T) {
+	rt.Config.WorkspaceConfig.WorkspaceVars = nil
+
+	tests := []struct {
+		name   string
+		config map[string]any
+		want   string
+	}{
+		{
+			name:   "self reference",
+			config: map[string]any{"a": "x${config.a}"},
+			want:   "variable 'a' refers to itself: a -> a",
+		},
+		{
+			name:   "cycle",
+			config: map[string]any{"a": "${config.b}", "b": "${config.c}", "c": "${config.a}"},
+			want:   "variable 'a' refers to itself: a -> b -> c -> a",
+		},
+		{
+			name:   "cycle through a nested value",
+			config: map[string]any{"a": []any{"${config.b}"}, "b": map[any]any{"x": "${config.a}"}},
+			want:   "variable 'a' refers to itself: a -> b -> a",
+		},
+		{
+			name:   "unset config key",
+			config: map[string]any{"a": "${config.missing}"},
+			want:   "variable 'a': cannot resolve ${config.missing}: config key 'missing' is not set",
+		},
+		{
+			name:   "missing field",
+			config: map[string]any{"db": map[any]any{"host": "h"}, "a": "${config.db.user}"},
+			want:   "variable 'a': cannot resolve ${config.db.user}: 'db' has no field 'user'",
+		},
+		{
+			name:   "field of a scalar",
+			config: map[string]any{"n": 1, "a": "${config.n.x}"},
+			want:   "variable 'a': cannot resolve ${config.n.x}: 'n' is not a map",
+		},
+		{
+			name:   "list inside a string",
+			config: map[string]any{"zones": []any{"a"}, "a": "zones: ${config.zones}"},
+			want:   "variable 'a': ${config.zones} is a list and cannot be part of a string",
+		},
+		{
+			name:   "unset environment variable",
+			config: map[string]any{"a": "${env.KAMAJI_TEST_UNSET}"},
+			want:   "variable 'a': cannot resolve ${env.KAMAJI_TEST_UNSET}: environment variable is not set",
+		},
+		{
+			name:   "unknown scope",
+			config: map[string]any{"a": "${secret.token}"},
+			want:   "variable 'a': cannot resolve ${secret.token}: unknown scope 'secret', use workspace, env, target or config",
+		},
+		{
+			name:   "missing name",
+			config: map[string]any{"a": "${target}"},
+			want:   "variable 'a': cannot resolve ${target}: expected ${scope.name}",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := &obj.ExecTarget{Name: "plan", Config: tt.config}
+			problems := interpolateConfig(target, nil)
+			if len(problems) != 1 {
+				t.Fatalf("interpolateConfig() problems = %v, want exactly one", problems)
+			}
+			if problems[0].Error() != tt.want {
+				t.Errorf("interpolateConfig() problem = %q, want %q", problems[0].Error(), tt.want)
+			}
+			if !reflect.DeepEqual(target.Config, tt.config) {
+				t.Errorf("interpolateConfig() changed the config of a target with problems")
+			}
+		})
+	}
+}
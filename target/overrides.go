@@ -0,0 +1,116 @@
+package target
+
+import (
+	"fmt"
+	"kamaji/label"
+	"kamaji/obj"
+	"kamaji/rt"
+	"reflect"
+	"slices"
+	"sort"
+
+	"gopkg.in/yaml.v2"
+)
+
+// applyOverrides applies the config overrides of every layer to the target, in
+// layer order. The config of a layer overrides a key when the target sets it or
+// its rule declares it; the config of the labels and patterns of a layer that
+// match the target is applied as it is. Values are merged like the layers of a
+// build file, so null removes a key.
+func applyOverrides(target *obj.ExecTarget, specs map[string]obj.VariableSpec) error {
+	if target.Config == nil {
+		target.Config = make(map[string]any)
+	}
+	if target.Origins == nil {
+		target.Origins = make(map[string]string)
+	}
+
+	for _, layer := range rt.Config.Layers {
+		for key, value := range layer.Overrides.Config {
+			_, set := target.Config[key]
+			_, declared := specs[key]
+			if set || declared {
+				overrideKey(target, key, overrideValue(value, specs[key]), layer.Origin)
+			}
+		}
+
+		patterns := make([]string, 0, len(layer.Overrides.Targets))
+		for pattern := range layer.Overrides.Targets {
+			patterns = append(patterns, pattern)
+		}
+		sort.Strings(patterns)
+
+		for _, pattern := range patterns {
+			matches, err := matchesTarget(pattern, *target)
+			if err != nil {
+				return fmt.Errorf("%s: %s", layer.Origin, err.Error())
+			}
+			if !matches {
+				continue
+			}
+			for key, value := range layer.Overrides.Targets[pattern] {
+				overrideKey(target, key, overrideValue(value, specs[key]), layer.Origin+" "+pattern)
+			}
+		}
+	}
+	return nil
+}
+
+func overrideKey(target *obj.ExecTarget, key string, value any, origin string) {
+	if value == nil {
+		delete(target.Config, key)
+		delete(target.Origins, "config."+key)
+		return
+	}
+	target.Config[key] = mergeValue(target.Config[key], value)
+	target.Origins["config."+key] = origin
+}
+
+// overrideValue converts a value set with --set or in the environment to the
+// type spec declares, parsing it as YAML. It stays a string for string types and
+// keys the rule does not declare, and when it does not parse, so the validation
+// reports the mismatch. An enum takes the parsed value only when it is one of
+// the allowed values.
+func overrideValue(value any, spec obj.VariableSpec) any {
+	raw, ok := value.(obj.RawOverride)
+	if !ok {
+		return value
+	}
+
+	switch spec.Type {
+	case "", "string", "path", "pattern":
+		return string(raw)
+	}
+
+	var parsed any
+	if err := yaml.Unmarshal([]byte(raw), &parsed); err != nil || (parsed == nil && raw != "~" && raw != "null") {
+		return string(raw)
+	}
+	if spec.Type == "enum" && !slices.ContainsFunc(spec.Values, func(allowed any) bool { return reflect.DeepEqual(allowed, parsed) }) {
+		return string(raw)
+	}
+	return parsed
+}
+
+// matchesTarget reports whether the label or pattern, relative to the workspace
+// root, selects the target.
+func matchesTarget(pattern string, target obj.ExecTarget) (bool, error) {
+	pkg, err := label.PackageOf(target.Dir)
+	if err != nil {
+		return false, nil
+	}
+
+	if label.IsPattern(pattern) {
+		p, err := label.ParsePattern(pattern, "")
+		if err != nil {
+			return false, err
+		}
+		return p.Matches(pkg, target.Name), nil
+	}
+
+	l, err := label.Parse(pattern, "")
+	if err != nil {
+		return false, err
+	}
+	return l.Package == pkg && l.Name == target.Name, nil
+}
@@ -0,0 +1,86 @@
+package target
+
+import (
+	"fmt"
+	"io/fs"
+	"kamaji/label"
+	"kamaji/obj"
+	"kamaji/rt"
+	"log"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// FindBuildFiles returns every build file named buildFileName under dir. Hidden
+// directories such as .git or .terraform are not searched.
+func FindBuildFiles(dir string, buildFileName string) ([]string, error) {
+	var buildFiles []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && path != dir && strings.HasPrefix(d.Name(), ".") {
+			return filepath.SkipDir
+		}
+		if !d.IsDir() && d.Name() == buildFileName {
+			buildFiles = append(buildFiles, path)
+		}
+		return nil
+	})
+	return buildFiles, err
+}
+
+// SelectTargets returns the targets matched by pattern that carry every tag in
+// tags. It is an error when nothing matches.
+func SelectTargets(pattern label.Pattern, buildFileName string, tags []string) ([]obj.ExecTarget, error) {
+	buildFileName = filepath.Base(buildFileName)
+	packageDir := label.BuildFile(label.Label{Package: pattern.Package}, "")
+
+	buildFiles := []string{filepath.Join(packageDir, buildFileName)}
+	if pattern.Recursive {
+		var err error
+		buildFiles, err = FindBuildFiles(packageDir, buildFileName)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var selected []obj.ExecTarget
+	for _, file := range buildFiles {
+		if rt.Config.DebugMode {
+			log.Printf("Selecting targets of %s\n", file)
+		}
+
+		buildFile, err := LoadBuildFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		pkg, err := label.PackageOf(filepath.Dir(file))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, target := range buildFile.Targets {
+			if pattern.Matches(pkg, target.Name) && HasTags(target, tags) {
+				selected = append(selected, target)
+			}
+		}
+	}
+
+	if len(selected) == 0 {
+		return nil, fmt.Errorf("no targets match the pattern")
+	}
+	return selected, nil
+}
+
+// HasTags reports whether target carries every tag in tags.
+func HasTags(target obj.ExecTarget, tags []string) bool {
+	for _, tag := range tags {
+		if !slices.Contains(target.Tags, tag) {
+			return false
+		}
+	}
+	return true
+}
@@ -1,213 +1,181 @@
 package target
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"io"
+	"kamaji/label"
 	"kamaji/obj"
 	"kamaji/rt"
 	"kamaji/tools"
 	"log"
-	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 
 	"gopkg.in/yaml.v2"
 )
 
-func ParseBuildFile(buildFileName string, targetName string) (obj.ExecTarget, error) {
+// LoadBuildFile reads and parses a build file without selecting any target.
+func LoadBuildFile(buildFileName string) (obj.BuildFile, error) {
 	if rt.Config.DebugMode {
 		log.Printf("Parsing build file: %s\n", buildFileName)
 	}
 
-	data, err := os.ReadFile(buildFileName)
+	var buildFile obj.BuildFile
+	absPath, err := filepath.Abs(buildFileName)
 	if err != nil {
-		return obj.ExecTarget{}, err
+		return buildFile, err
+	}
+
+	data, err := os.ReadFile(absPath)
+	if err != nil {
+		return buildFile, err
 	}
 
-	var buildFile obj.BuildFile
 	if err := yaml.Unmarshal(data, &buildFile); err != nil {
-		return obj.ExecTarget{}, err
+		return buildFile, fmt.Errorf("failed to parse %s: %s", buildFileName, err.Error())
 	}
 
-	for _, target := range buildFile.Targets {
-		if target.Name == targetName {
-			return target, nil
-		}
+	if err := expandBuildFile(&buildFile, absPath); err != nil {
+		return buildFile, fmt.Errorf("failed to expand %s: %s", buildFileName, err.Error())
 	}
 
-	return obj.ExecTarget{}, fmt.Errorf("target %s not found", targetName)
+	dir := filepath.Dir(absPath)
+	for i := range buildFile.Targets {
+		buildFile.Targets[i].BuildFile = absPath
+		buildFile.Targets[i].Dir = dir
+		buildFile.Targets[i].Label = targetLabel(dir, buildFile.Targets[i].Name)
+	}
+
+	return buildFile, nil
 }
 
-// loadExpectedVariables is a private helper that reads the rule_definition.yaml file
-// and returns the contents of its "variables" section as a map.
-func loadExpectedVariables(filePath string) (map[string]any, error) {
-	data, err := os.ReadFile(filePath)
+// targetLabel returns the label of a target of the build file in dir. Build
+// files outside of the workspace have no package, so their directory is used.
+func targetLabel(dir string, name string) string {
+	pkg, err := label.PackageOf(dir)
 	if err != nil {
-		fmt.Printf("Error reading variables file: %s\n", err.Error())
-		return nil, err
+		return dir + ":" + name
 	}
+	return label.Label{Package: pkg, Name: name}.String()
+}
 
-	// Unmarshal the whole file into a generic map
-	var yamlContent map[string]any
-	err = yaml.Unmarshal(data, &yamlContent)
-	if err != nil {
-		return nil, err
+// ResolveTarget finds the target named on the command line. A bare name or
+// ":name" is looked up in buildFileName, any other label in the build file of
+// its package, which has the same base name as buildFileName.
+func ResolveTarget(arg string, buildFileName string) (obj.ExecTarget, error) {
+	if !label.IsLabel(arg) || strings.HasPrefix(arg, ":") {
+		return ParseBuildFile(buildFileName, strings.TrimPrefix(arg, ":"))
 	}
 
-	// Extract the "variables" section
-	variablesSection, ok := yamlContent["variables"]
-	if !ok {
-		return nil, fmt.Errorf("no 'variables' section found in the YAML file")
+	pkg, err := label.PackageOf(".")
+	if err != nil {
+		return obj.ExecTarget{}, err
 	}
 
-	var variablesMap map[string]any
-	switch v := variablesSection.(type) {
-	case map[string]any:
-		variablesMap = v
-	case map[any]any:
-		variablesMap = make(map[string]any)
-		for key, value := range v {
-			strKey, ok := key.(string)
-			if !ok {
-				return nil, fmt.Errorf("non-string key found in variables section: %v", key)
-			}
-			variablesMap[strKey] = value
-		}
-	default:
-		return nil, fmt.Errorf("'variables' section is not a valid map")
+	l, err := label.Parse(arg, pkg)
+	if err != nil {
+		return obj.ExecTarget{}, err
 	}
 
-	return variablesMap, nil
+	return ParseBuildFile(label.BuildFile(l, filepath.Base(buildFileName)), l.Name)
 }
 
-func ValidateTargetVariables(target map[string]any) {
-	definitionFile := filepath.Join(rt.Config.WorkspaceConfig.RulesDir, filepath.Dir(rt.Config.ExecTarget.Rule), "rule_definition.yaml")
-	expectedTypes, err := loadExpectedVariables(definitionFile)
+func ParseBuildFile(buildFileName string, targetName string) (obj.ExecTarget, error) {
+	buildFile, err := LoadBuildFile(buildFileName)
 	if err != nil {
-		log.Printf("No variables file found for rule %s\n", filepath.Base(rt.Config.ExecTarget.Rule))
-		os.Exit(1)
-	}
-
-	// Iterate over each expected variable
-	for varName, expectedValue := range expectedTypes {
-		var expectedType string
-
-		// Determine the expected type depending on the format provided in YAML.
-		switch v := expectedValue.(type) {
-		case string:
-			// The expected type is provided directly as a string.
-			expectedType = v
-		case map[string]any:
-			// If the expected value is a map, look up the "type" key.
-			if typeVal, exists := v["type"]; exists {
-				if typeStr, ok := typeVal.(string); ok {
-					expectedType = typeStr
-				} else {
-					fmt.Printf("Expected type for variable '%s' should be a string; got %T\n", varName, typeVal)
-					continue
-				}
-			} else {
-				fmt.Printf("No 'type' key found for variable '%s'\n", varName)
-				continue
-			}
-		case map[any]any:
-			// Convert this map to map[string]any
-			conv := make(map[string]any)
-			for key, val := range v {
-				strKey, ok := key.(string)
-				if !ok {
-					fmt.Printf("Key is not a string: %v\n", key)
-					continue
-				}
-				conv[strKey] = val
-			}
-			if typeVal, exists := conv["type"]; exists {
-				if typeStr, ok := typeVal.(string); ok {
-					expectedType = typeStr
-				} else {
-					fmt.Printf("Expected type for variable '%s' should be a string; got %T\n", varName, typeVal)
-					continue
-				}
-			} else {
-				fmt.Printf("No 'type' key found for variable '%s'\n", varName)
-				continue
-			}
-		default:
-			fmt.Printf("Unsupported expected type format for variable '%s': %T\n", varName, expectedValue)
-			continue
-		}
-
-		// Retrieve the actual variable value from target
-		actualValue, exists := target[varName]
-		if !exists {
-			fmt.Printf("Variable '%s' is missing in the target configuration.\n", varName)
-			continue
-		}
+		return obj.ExecTarget{}, err
+	}
 
-		// Determine the type of the actual value using our helper function.
-		actualType := determineVariableType(actualValue)
-		if actualType != expectedType {
-			fmt.Printf("Type mismatch for variable '%s': expected '%s', got '%s'\n", varName, expectedType, actualType)
-			os.Exit(1)
+	for _, target := range buildFile.Targets {
+		if target.Name == targetName {
+			return target, nil
 		}
 	}
-}
 
-func determineVariableType(value any) string {
-	switch value.(type) {
-	case string:
-		return "string"
-	case int:
-		return "int"
-	case bool:
-		return "bool"
-	// Add more types as needed
-	default:
-		return "unknown"
-	}
+	return obj.ExecTarget{}, fmt.Errorf("target %s not found", targetName)
 }
 
-func InitThirdPartyUsedInTarget(workspaceConfig obj.WorkspaceConfig, target obj.ExecTarget) error {
-	var lastError error
+// ThirdPartyReferences returns the sorted names of the third parties the config
+// of target references with the @@ prefix.
+func ThirdPartyReferences(target obj.ExecTarget) []string {
+	var names []string
 	for _, value := range target.Config {
 		if strValue, ok := value.(string); ok && strings.HasPrefix(strValue, "@@") {
-			downloadCandidate := strValue[2:]
-			if err := downloadThirdParty(workspaceConfig, downloadCandidate); err != nil {
-				log.Printf("Error downloading %s: %v", downloadCandidate, err)
-				lastError = err
+			names = append(names, strValue[2:])
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// thirdPartyLocks serializes the download of each third party, so targets
+// running concurrently do not write the same cache entry at once.
+var thirdPartyLocks sync.Map
+
+// InitThirdPartyUsedInTarget downloads or validates every third party the target
+// of run references, concurrently, and records where they are cached in
+// run.ThirdPartyFiles. Cancelling ctx stops the downloads.
+func InitThirdPartyUsedInTarget(ctx context.Context, workspaceConfig obj.WorkspaceConfig, run *obj.TargetRun) error {
+	names := ThirdPartyReferences(run.Target)
+	fileInfos := make([]obj.ThirdPartyFileInfo, len(names))
+	errs := make([]error, len(names))
+
+	var wg sync.WaitGroup
+	for i, name := range names {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			fileInfo, err := downloadThirdParty(ctx, workspaceConfig, name)
+			if err != nil {
+				// reported once by the caller, together with the target
+				errs[i] = fmt.Errorf("third party %s: %w", name, err)
+				return
 			}
+			fileInfos[i] = fileInfo
+		}()
+	}
+	wg.Wait()
+
+	for i, name := range names {
+		if errs[i] == nil {
+			run.ThirdPartyFiles[name] = fileInfos[i]
 		}
 	}
-	return lastError
+	return errors.Join(errs...)
 }
 
-func downloadThirdParty(workspaceConfig obj.WorkspaceConfig, downloadCandidate string) error {
+func downloadThirdParty(ctx context.Context, workspaceConfig obj.WorkspaceConfig, downloadCandidate string) (obj.ThirdPartyFileInfo, error) {
 	if rt.Config.DebugMode {
 		log.Printf("Looking for third party config for %s\n", downloadCandidate)
 	}
-	thirdParty, err := findThirdPartyConfig(workspaceConfig, downloadCandidate)
+	thirdParty, err := FindThirdPartyConfig(workspaceConfig, downloadCandidate)
 	if err != nil {
-		log.Fatalf("Third party config requested from BUILD.yaml for %s is not present in workspace config.\n", downloadCandidate)
+		return obj.ThirdPartyFileInfo{}, fmt.Errorf("third party config requested from BUILD.yaml for %s is not present in workspace config", downloadCandidate)
 	}
 
+	lock, _ := thirdPartyLocks.LoadOrStore(thirdParty.Name, &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	defer lock.(*sync.Mutex).Unlock()
+
 	if doesThirdPartyExist(thirdParty.Name) {
 		if rt.Config.DebugMode {
 			log.Printf("Third party %s already exists, skipping\n", thirdParty.Name)
 		}
-		return validateCachedFile(thirdParty)
-	}
-
-	err = downloadAndCacheFile(thirdParty)
-	if err != nil {
-		log.Printf("Failed to download and cache file: %s\n", err.Error())
-		return err
+		fileInfo, err := validateCachedFile(thirdParty)
+		if err == nil {
+			return fileInfo, nil
+		}
+		log.Printf("Cached file of %s is invalid, downloading it again\n", thirdParty.Name)
 	}
 
-	return nil
+	return downloadAndCacheFile(ctx, thirdParty)
 }
 
-func findThirdPartyConfig(workspaceConfig obj.WorkspaceConfig, downloadCandidate string) (obj.ThirdPartyConfig, error) {
+func FindThirdPartyConfig(workspaceConfig obj.WorkspaceConfig, downloadCandidate string) (obj.ThirdPartyConfig, error) {
 	for _, thirdParty := range workspaceConfig.ThirdParty {
 		if thirdParty.Name == downloadCandidate {
 			return thirdParty, nil
@@ -230,7 +198,7 @@ func doesThirdPartyExist(downloadCandidate string) bool {
 		return false
 	}
 
-	dirToCheck := filepath.Join(rt.Config.CacheDir, sha256)
+	dirToCheck := filepath.Join(rt.Config.CacheDir, sha256, "file")
 	if rt.Config.DebugMode {
 		log.Printf("Checking if third party exists: %s\n", dirToCheck)
 	}
@@ -248,53 +216,69 @@ func doesThirdPartyExist(downloadCandidate string) bool {
 	return true
 }
 
-func downloadAndCacheFile(thirdParty obj.ThirdPartyConfig) error {
-	fmt.Printf("Downloading Third Party: %s\n", thirdParty.Name)
-	if rt.Config.DebugMode {
-		log.Printf("Downloading Third Party: %s\n", thirdParty.Name)
+// CacheStatus describes whether the file of thirdParty for the current platform
+// is present in the cache and matches its sha256, without downloading anything.
+func CacheStatus(thirdParty obj.ThirdPartyConfig) string {
+	sha256 := thirdParty.SHA256s[rt.Config.Platform]
+	if sha256 == "" {
+		return "no sha256 for " + rt.Config.Platform
 	}
 
-	sha256, url := thirdParty.SHA256s[rt.Config.Platform], thirdParty.URLs[rt.Config.Platform]
-	if sha256 == "" || url == "" {
-		return fmt.Errorf("sha256 or url is empty for %s", thirdParty.Name)
+	filePath := filepath.Join(rt.Config.CacheDir, sha256, "file")
+	if _, err := os.Stat(filePath); err != nil {
+		return "not cached"
 	}
 
+	if !tools.IsFileValid(filePath, sha256) {
+		return "cached, sha256 mismatch"
+	}
+	return "cached"
+}
+
+func downloadAndCacheFile(ctx context.Context, thirdParty obj.ThirdPartyConfig) (obj.ThirdPartyFileInfo, error) {
+	fmt.Printf("Downloading Third Party: %s\n", thirdParty.Name)
 	if rt.Config.DebugMode {
-		log.Printf("Downloading Third Party: %s from %s\n", thirdParty.Name, url)
+		log.Printf("Downloading Third Party: %s\n", thirdParty.Name)
+	}
+
+	sha256, urls := thirdParty.SHA256s[rt.Config.Platform], DownloadURLs(thirdParty)
+	if sha256 == "" || len(urls) == 0 {
+		return obj.ThirdPartyFileInfo{}, fmt.Errorf("sha256 or url is empty for %s", thirdParty.Name)
 	}
 
 	cacheDir := filepath.Join(rt.Config.CacheDir, sha256)
 	if err := os.MkdirAll(cacheDir, 0755); err != nil {
-		return fmt.Errorf("failed to create cache dir: %s", err.Error())
+		return obj.ThirdPartyFileInfo{}, fmt.Errorf("failed to create cache dir: %s", err.Error())
 	}
 
-	filePath := filepath.Join(cacheDir, "file")
-	if err := downloadFile(url, filePath); err != nil {
-		if rt.Config.DebugMode {
-			log.Printf("Failed to download file: %s\n", err.Error())
-		}
-		return err
+	sources := make([]downloadSource, len(urls))
+	for i, url := range urls {
+		sources[i] = downloadSource{url: url, auth: downloadAuth(thirdParty, url)}
 	}
-
-	if !tools.IsFileValid(filePath, sha256) {
-		if rt.Config.DebugMode {
-			log.Printf("File is invalid\n")
-		}
-		return fmt.Errorf("file is invalid")
+	if err := downloadFile(ctx, filepath.Join(cacheDir, "file"), sha256, sources...); err != nil {
+		return obj.ThirdPartyFileInfo{}, err
 	}
 
 	if err := tools.CreateMetadataFile(cacheDir, thirdParty.FilePath); err != nil {
-		return err
+		return obj.ThirdPartyFileInfo{}, err
 	}
 
-	rt.Config.ThirdPartyFiles[thirdParty.Name] = obj.ThirdPartyFileInfo{
-		FileName:  cacheDir,
-		FinalName: thirdParty.FilePath,
+	return FileInfo(thirdParty), nil
+}
+
+// FileInfo returns where the file of thirdParty for the current platform is
+// cached and how it is extracted.
+func FileInfo(thirdParty obj.ThirdPartyConfig) obj.ThirdPartyFileInfo {
+	return obj.ThirdPartyFileInfo{
+		FileName:    filepath.Join(rt.Config.CacheDir, thirdParty.SHA256s[rt.Config.Platform]),
+		FinalName:   thirdParty.FilePath,
+		ArchiveType: thirdParty.ArchiveType,
+		StripPrefix: thirdParty.StripPrefix.For(rt.Config.Platform),
+		Executable:  thirdParty.Executable,
 	}
-	return nil
 }
 
-func validateCachedFile(thirdParty obj.ThirdPartyConfig) error {
+func validateCachedFile(thirdParty obj.ThirdPartyConfig) (obj.ThirdPartyFileInfo, error) {
 	if rt.Config.DebugMode {
 		log.Printf("Validating cached file for %s\n", thirdParty.Name)
 	}
@@ -303,44 +287,21 @@ func validateCachedFile(thirdParty obj.ThirdPartyConfig) error {
 
 	if !tools.IsFileValid(filePath, thirdParty.SHA256s[rt.Config.Platform]) {
 		log.Printf("Cached file is invalid\n")
-		return fmt.Errorf("file is invalid")
-	}
-
-	rt.Config.ThirdPartyFiles[thirdParty.Name] = obj.ThirdPartyFileInfo{
-		FileName:  cacheDir,
-		FinalName: thirdParty.FilePath,
+		return obj.ThirdPartyFileInfo{}, fmt.Errorf("file is invalid")
 	}
 
 	if rt.Config.DebugMode {
 		log.Printf("Cached file is valid\n")
 	}
 
-	return nil
-}
-
-func downloadFile(url, filePath string) error {
-	resp, err := http.Get(url)
-	if err != nil {
-		return fmt.Errorf("failed to download file: %s", err.Error())
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("failed to download file: %s", resp.Status)
-	}
-
-	out, err := os.Create(filePath)
-	if err != nil {
-		return fmt.Errorf("failed to create file: %s", err.Error())
-	}
-	defer out.Close()
-
-	if _, err := io.Copy(out, resp.Body); err != nil {
-		return fmt.Errorf("failed to copy file: %s", err.Error())
+	// the metadata is written after the file is moved into the cache, so it is
+	// missing when that failed or Kamaji was stopped in between
+	if _, err := os.Stat(filepath.Join(cacheDir, "metadata")); os.IsNotExist(err) {
+		log.Printf("Metadata of %s is missing, creating it again\n", thirdParty.Name)
+		if err := tools.CreateMetadataFile(cacheDir, thirdParty.FilePath); err != nil {
+			return obj.ThirdPartyFileInfo{}, err
+		}
 	}
 
-	if rt.Config.DebugMode {
-		log.Printf("Downloaded file to: %s\n", filePath)
-	}
-	return nil
+	return FileInfo(thirdParty), nil
 }
@@ -0,0 +1,200 @@
+package target
+
+import (
+	"context"
+	"fmt"
+	"kamaji/obj"
+	"kamaji/rt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testPlatform = "linux_amd64"
+
+// fileServer serves /<name> with the content of the third party name, slowly
+// enough for concurrent downloads to overlap, and counts the requests.
+type fileServer struct {
+	mu       sync.Mutex
+	files    map[string][]byte
+	requests map[string]int
+	running  int
+	peak     int
+}
+
+func newFileServer(files map[string][]byte) *fileServer {
+	return &fileServer{files: files, requests: make(map[string]int)}
+}
+
+func (s *fileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/")
+	s.mu.Lock()
+	s.requests[name]++
+	s.running++
+	s.peak = max(s.peak, s.running)
+	content, ok := s.files[name]
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		s.running--
+		s.mu.Unlock()
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Write(content)
+}
+
+// useThirdParty makes the third parties served by server, plus the broken ones
+// it does not serve, the ones of the workspace, cached in a temporary directory.
+func useThirdParty(t *testing.T, server *httptest.Server, files map[string][]byte, broken ...string) {
+	t.Helper()
+	fastRetries(t)
+	config := rt.Config
+	t.Cleanup(func() { rt.Config = config })
+
+	rt.Config.CacheDir = t.TempDir()
+	rt.Config.Platform = testPlatform
+	rt.Config.Layers = nil
+	rt.Config.WorkspaceConfig.ThirdParty = nil
+	for name, content := range files {
+		addThirdParty(server, name, sha256Of(content))
+	}
+	for _, name := range broken {
+		addThirdParty(server, name, sha256Of([]byte(name)))
+	}
+}
+
+func addThirdParty(server *httptest.Server, name string, sha256 string) {
+	rt.Config.WorkspaceConfig.ThirdParty = append(rt.Config.WorkspaceConfig.ThirdParty, obj.ThirdPartyConfig{
+		Name:     name,
+		FilePath: name,
+		URLs:     map[string]obj.URLList{testPlatform: {server.URL + "/" + name}},
+		SHA256s:  map[string]string{testPlatform: sha256},
+	})
+}
+
+func newRun(names ...string) *obj.TargetRun {
+	config := make(map[string]any)
+	for _, name := range names {
+		config[name] = "@@" + name
+	}
+	return &obj.TargetRun{
+		Target:          obj.ExecTarget{Name: "t", Config: config},
+		ThirdPartyFiles: make(map[string]obj.ThirdPartyFileInfo),
+	}
+}
+
+func TestInitThirdPartyUsedInTarget(t *testing.T) {
+	files := make(map[string][]byte)
+	var names []string
+	for i := range 2 * maxParallelDownloads {
+		name := fmt.Sprintf("tool_%d", i)
+		files[name] = []byte(strings.Repeat(name+" ", 100))
+		names = append(names, name)
+	}
+	fs := newFileServer(files)
+	server := httptest.NewServer(fs)
+	defer server.Close()
+	useThirdParty(t, server, files)
+
+	// targets running at the same time share their third parties
+	runs := []*obj.TargetRun{newRun(names...), newRun(names...), newRun(names[:2]...)}
+	errs := make([]error, len(runs))
+	var wg sync.WaitGroup
+	for i, run := range runs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = InitThirdPartyUsedInTarget(context.Background(), rt.Config.WorkspaceConfig, run)
+		}()
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("InitThirdPartyUsedInTarget() of run %d error = %v", i, err)
+		}
+	}
+	for _, name := range names {
+		if fs.requests[name] != 1 {
+			t.Errorf("%s was requested %d times, want once", name, fs.requests[name])
+		}
+	}
+	if fs.peak > maxParallelDownloads {
+		t.Errorf("%d downloads ran at once, want at most %d", fs.peak, maxParallelDownloads)
+	}
+
+	for _, name := range names {
+		fileInfo, ok := runs[0].ThirdPartyFiles[name]
+		if !ok {
+			t.Fatalf("no file recorded for %s", name)
+		}
+		if want := filepath.Join(rt.Config.CacheDir, sha256Of(files[name])); fileInfo.FileName != want || fileInfo.FinalName != name {
+			t.Errorf("file of %s = %+v, want it cached in %s", name, fileInfo, want)
+		}
+		metadata, err := os.ReadFile(filepath.Join(fileInfo.FileName, "metadata"))
+		if err != nil || !strings.HasPrefix(string(metadata), name+",") {
+			t.Errorf("metadata of %s = %q, %v", name, metadata, err)
+		}
+	}
+}
+
+func TestInitThirdPartyUsedInTargetRecreatesMetadata(t *testing.T) {
+	files := map[string][]byte{"tool": []byte(strings.Repeat("tool ", 100))}
+	fs := newFileServer(files)
+	server := httptest.NewServer(fs)
+	defer server.Close()
+	useThirdParty(t, server, files)
+
+	if err := InitThirdPartyUsedInTarget(context.Background(), rt.Config.WorkspaceConfig, newRun("tool")); err != nil {
+		t.Fatalf("InitThirdPartyUsedInTarget() error = %v", err)
+	}
+	metadataPath := filepath.Join(rt.Config.CacheDir, sha256Of(files["tool"]), "metadata")
+	if err := os.Remove(metadataPath); err != nil {
+		t.Fatal(err)
+	}
+
+	run := newRun("tool")
+	if err := InitThirdPartyUsedInTarget(context.Background(), rt.Config.WorkspaceConfig, run); err != nil {
+		t.Fatalf("InitThirdPartyUsedInTarget() with missing metadata error = %v", err)
+	}
+	if fs.requests["tool"] != 1 {
+		t.Errorf("tool was requested %d times, want the cached file to be used", fs.requests["tool"])
+	}
+	if _, ok := run.ThirdPartyFiles["tool"]; !ok {
+		t.Errorf("no file recorded for tool")
+	}
+	if metadata, err := os.ReadFile(metadataPath); err != nil || !strings.HasPrefix(string(metadata), "tool,") {
+		t.Errorf("recreated metadata = %q, %v", metadata, err)
+	}
+}
+
+func TestInitThirdPartyUsedInTargetFailure(t *testing.T) {
+	files := map[string][]byte{"tool": []byte(strings.Repeat("tool ", 100))}
+	fs := newFileServer(files)
+	server := httptest.NewServer(fs)
+	defer server.Close()
+	useThirdParty(t, server, files, "missing")
+
+	run := newRun("tool", "missing")
+	err := InitThirdPartyUsedInTarget(context.Background(), rt.Config.WorkspaceConfig, run)
+	if err == nil || !strings.HasPrefix(err.Error(), "third party missing: ") || !strings.Contains(err.Error(), "404") {
+		t.Fatalf("InitThirdPartyUsedInTarget() error = %v, want the 404 of missing", err)
+	}
+	if _, ok := run.ThirdPartyFiles["tool"]; !ok {
+		t.Errorf("no file recorded for tool, which downloaded fine")
+	}
+	if _, ok := run.ThirdPartyFiles["missing"]; ok {
+		t.Errorf("a file is recorded for missing")
+	}
+}
@@ -0,0 +1,338 @@
+package target
+
+import (
+	"errors"
+	"fmt"
+	"kamaji/obj"
+	"kamaji/rt"
+	"kamaji/tools"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// loadRuleDefinition is a private helper that reads the rule_definition.yaml file
+// that sits next to a rule and returns its parsed contents.
+func loadRuleDefinition(filePath string) (obj.RuleDefinition, error) {
+	var definition obj.RuleDefinition
+
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return definition, err
+	}
+
+	if err := yaml.Unmarshal(data, &definition); err != nil {
+		return definition, fmt.Errorf("failed to parse %s: %s", filePath, err.Error())
+	}
+
+	if definition.Variables == nil {
+		return definition, fmt.Errorf("no 'variables' section found in %s", filePath)
+	}
+
+	return definition, nil
+}
+
+func ruleDefinitionPath(target obj.ExecTarget) string {
+	return filepath.Join(rt.Config.WorkspaceConfig.RulesDir, filepath.Dir(target.Rule), "rule_definition.yaml")
+}
+
+// ValidateTargetVariables checks the timeout of the target, applies the config
+// overrides, fills in the defaults of missing variables, expands the references
+// in the config of the target and checks it against the rule_definition.yaml of
+// its rule. Every problem found is reported in a single error.
+func ValidateTargetVariables(target *obj.ExecTarget) error {
+	definitionFile := ruleDefinitionPath(*target)
+	if rt.Config.DebugMode {
+		log.Printf("Validating target %s against %s\n", target.Name, definitionFile)
+	}
+
+	if target.Timeout != "" {
+		if _, err := time.ParseDuration(target.Timeout); err != nil {
+			return fmt.Errorf("invalid timeout for target %s: %s", target.Name, err.Error())
+		}
+	}
+
+	definition, err := loadRuleDefinition(definitionFile)
+	if err != nil {
+		return fmt.Errorf("cannot load rule definition for rule %s: %s", target.Rule, err.Error())
+	}
+
+	if target.Config == nil {
+		target.Config = make(map[string]any)
+	}
+
+	if err := applyOverrides(target, definition.Variables); err != nil {
+		return fmt.Errorf("cannot apply config overrides to target %s: %s", target.Name, err.Error())
+	}
+
+	defaultOrigin := filepath.Join(filepath.Dir(target.Rule), "rule_definition.yaml") + " default"
+	for name, spec := range definition.Variables {
+		if _, set := target.Config[name]; !set && spec.Default != nil {
+			target.Origins["config."+name] = defaultOrigin
+		}
+	}
+	fillDefaults(target.Config, definition.Variables)
+
+	if problems := interpolateConfig(target, definition.Variables); len(problems) > 0 {
+		return fmt.Errorf("invalid config for target %s:\n%w", target.Name, errors.Join(problems...))
+	}
+
+	strict := definition.Strict || rt.Config.WorkspaceConfig.StrictConfig
+	problems := validateFields("", target.Config, definition.Variables, strict)
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid config for target %s:\n%w", target.Name, errors.Join(problems...))
+	}
+
+	return nil
+}
+
+// validateFields validates every declared field of fields in place, replacing
+// nested values by their normalized form. In strict mode fields that have no
+// spec are reported as well.
+func validateFields(prefix string, fields map[string]any, specs map[string]obj.VariableSpec, strict bool) []error {
+	names := make([]string, 0, len(specs))
+	for name := range specs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var problems []error
+	if strict {
+		problems = append(problems, unknownFields(prefix, fields, names)...)
+	}
+
+	for _, name := range names {
+		spec := specs[name]
+		path := prefix + name
+
+		value, exists := fields[name]
+		if !exists {
+			// fillDefaults set the variables that have a default
+			if spec.Mandatory {
+				problems = append(problems, fmt.Errorf("mandatory variable '%s' is missing", path))
+			}
+			continue
+		}
+
+		normalized, errs := validateValue(path, value, spec, strict)
+		if len(errs) > 0 {
+			problems = append(problems, errs...)
+			continue
+		}
+		fields[name] = normalized
+	}
+
+	return problems
+}
+
+// fillDefaults sets the missing fields that declare a default, including the
+// properties of the objects that are set. It runs before references are
+// expanded, so a default such as "${target.name}.tfstate" is expanded too.
+func fillDefaults(fields map[string]any, specs map[string]obj.VariableSpec) {
+	for name, spec := range specs {
+		value, exists := fields[name]
+		if !exists {
+			if spec.Default != nil {
+				fields[name] = spec.Default
+			}
+			continue
+		}
+		if spec.Type == "object" {
+			if object, ok := toStringMap(value); ok {
+				fillDefaults(object, spec.Properties)
+				fields[name] = object
+			}
+		}
+	}
+}
+
+// validateValue checks a single value against its spec and returns the value
+// with YAML maps converted to map[string]any.
+func validateValue(path string, value any, spec obj.VariableSpec, strict bool) (any, []error) {
+	mismatch := func() []error {
+		return []error{fmt.Errorf("type mismatch for variable '%s': expected '%s', got '%s'", path, spec.Type, determineVariableType(value))}
+	}
+
+	switch spec.Type {
+	case "":
+		return nil, []error{fmt.Errorf("variable '%s' has no type in the rule definition", path)}
+
+	case "string", "path", "pattern":
+		str, ok := value.(string)
+		if !ok {
+			return nil, mismatch()
+		}
+		if spec.Type == "path" && str == "" {
+			return nil, []error{fmt.Errorf("variable '%s' must be a non-empty path", path)}
+		}
+		if spec.Type == "pattern" && spec.Pattern == "" {
+			return nil, []error{fmt.Errorf("variable '%s' is of type 'pattern' but declares no pattern", path)}
+		}
+		if spec.Pattern != "" {
+			re, err := regexp.Compile("^(?:" + spec.Pattern + ")$")
+			if err != nil {
+				return nil, []error{fmt.Errorf("variable '%s' declares an invalid pattern: %s", path, err.Error())}
+			}
+			if !re.MatchString(str) {
+				return nil, []error{fmt.Errorf("variable '%s': value '%s' does not match pattern '%s'", path, str, spec.Pattern)}
+			}
+		}
+		return str, nil
+
+	case "int":
+		switch value.(type) {
+		case int, int64, uint64:
+			return value, nil
+		}
+		return nil, mismatch()
+
+	case "float":
+		switch value.(type) {
+		case float64, int, int64, uint64:
+			return value, nil
+		}
+		return nil, mismatch()
+
+	case "bool":
+		if _, ok := value.(bool); !ok {
+			return nil, mismatch()
+		}
+		return value, nil
+
+	case "duration":
+		str, ok := value.(string)
+		if !ok {
+			return nil, mismatch()
+		}
+		if _, err := time.ParseDuration(str); err != nil {
+			return nil, []error{fmt.Errorf("variable '%s': '%s' is not a valid duration", path, str)}
+		}
+		return str, nil
+
+	case "enum":
+		if len(spec.Values) == 0 {
+			return nil, []error{fmt.Errorf("variable '%s' is of type 'enum' but declares no values", path)}
+		}
+		for _, allowed := range spec.Values {
+			if reflect.DeepEqual(value, allowed) {
+				return value, nil
+			}
+		}
+		allowed := make([]string, len(spec.Values))
+		for i, v := range spec.Values {
+			allowed[i] = fmt.Sprintf("%v", v)
+		}
+		return nil, []error{fmt.Errorf("variable '%s': '%v' is not one of [%s]", path, value, strings.Join(allowed, ", "))}
+
+	case "list":
+		items, ok := value.([]any)
+		if !ok {
+			return nil, mismatch()
+		}
+		result := make([]any, len(items))
+		var problems []error
+		for i, item := range items {
+			if spec.Items == nil {
+				result[i] = item
+				continue
+			}
+			normalized, errs := validateValue(fmt.Sprintf("%s[%d]", path, i), item, *spec.Items, strict)
+			problems = append(problems, errs...)
+			result[i] = normalized
+		}
+		return result, problems
+
+	case "map", "object":
+		fields, ok := toStringMap(value)
+		if !ok {
+			return nil, mismatch()
+		}
+		if spec.Type == "object" {
+			return fields, validateFields(path+".", fields, spec.Properties, strict)
+		}
+		var problems []error
+		if spec.Items != nil {
+			for key, item := range fields {
+				normalized, errs := validateValue(path+"."+key, item, *spec.Items, strict)
+				problems = append(problems, errs...)
+				fields[key] = normalized
+			}
+		}
+		return fields, problems
+
+	default:
+		return nil, []error{fmt.Errorf("variable '%s' has unknown type '%s' in the rule definition", path, spec.Type)}
+	}
+}
+
+// unknownFields reports the keys of fields that are not in declared, suggesting
+// the closest declared name when there is a plausible one.
+func unknownFields(prefix string, fields map[string]any, declared []string) []error {
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var problems []error
+	for _, key := range keys {
+		if slices.Contains(declared, key) {
+			continue
+		}
+		if suggestion := tools.ClosestMatch(key, declared); suggestion != "" {
+			problems = append(problems, fmt.Errorf("unknown variable '%s%s', did you mean '%s%s'?", prefix, key, prefix, suggestion))
+		} else {
+			problems = append(problems, fmt.Errorf("unknown variable '%s%s'", prefix, key))
+		}
+	}
+	return problems
+}
+
+// toStringMap returns a copy of a YAML mapping with its keys converted to strings.
+func toStringMap(value any) (map[string]any, bool) {
+	switch v := value.(type) {
+	case map[string]any:
+		result := make(map[string]any, len(v))
+		for key, item := range v {
+			result[key] = item
+		}
+		return result, true
+	case map[any]any:
+		result := make(map[string]any, len(v))
+		for key, item := range v {
+			result[fmt.Sprintf("%v", key)] = item
+		}
+		return result, true
+	default:
+		return nil, false
+	}
+}
+
+func determineVariableType(value any) string {
+	switch value.(type) {
+	case string:
+		return "string"
+	case int, int64, uint64:
+		return "int"
+	case float64:
+		return "float"
+	case bool:
+		return "bool"
+	case []any:
+		return "list"
+	case map[string]any, map[any]any:
+		return "map"
+	case nil:
+		return "null"
+	default:
+		return "unknown"
+	}
+}
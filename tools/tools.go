@@ -2,6 +2,7 @@ package tools
 
 import (
 	"archive/zip"
+	"bytes"
 	"crypto/sha256"
 	"fmt"
 	"io"
@@ -11,6 +12,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/h2non/filetype"
@@ -33,34 +35,28 @@ func GetRule(target obj.ExecTarget) (string, error) {
 	return target.Rule, nil
 }
 
+// CreateMetadataFile records the file name and the detected type of the file
+// cached in cacheDir. The metadata file is written under a temporary name and
+// renamed, so it is either missing or complete.
 func CreateMetadataFile(cacheDir string, filePath string) error {
 	if rt.Config.DebugMode {
 		log.Printf("Creating metadata file for: %s\n", filePath)
 	}
 
-	metadataFilePath := filepath.Join(cacheDir, "metadata")
-	metadataFile, err := os.Create(metadataFilePath)
-	if err != nil {
-		return fmt.Errorf("failed to create metadata file: %s", err.Error())
-	}
-	defer metadataFile.Close()
-
 	downloadedFilePath := filepath.Join(cacheDir, "file")
 	fileType, err := determineFileType(downloadedFilePath)
 	if err != nil {
 		return fmt.Errorf("failed to determine file type: %s", err.Error())
 	}
 
-	switch fileType {
-	case "application/zip":
-		Unzip(filePath, cacheDir)
-	case "x-mach-binary":
-		mac_binary(filePath, cacheDir)
-		// TODO: add linux_binary
-	}
-
+	// the file is extracted by the archive handler of its type when a
+	// target first uses it
 	finalContent := fmt.Sprintf("%s,%s", filePath, fileType)
-	if _, err := metadataFile.WriteString(finalContent); err != nil {
+	metadataFilePath := filepath.Join(cacheDir, "metadata")
+	if err := os.WriteFile(metadataFilePath+".tmp", []byte(finalContent), 0644); err != nil {
+		return fmt.Errorf("failed to write metadata file: %s", err.Error())
+	}
+	if err := os.Rename(metadataFilePath+".tmp", metadataFilePath); err != nil {
 		return fmt.Errorf("failed to write metadata file: %s", err.Error())
 	}
 
@@ -70,19 +66,6 @@ func CreateMetadataFile(cacheDir string, filePath string) error {
 	return nil
 }
 
-func mac_binary(filePath string, cacheDir string) error {
-	// in this case the file is a binary file, we just need to make executable
-	// after we copy it in the __TMP__ directory and rename it to the final name
-
-	binaryFilePath := filepath.Join(cacheDir, "__TMP__", "file")
-	if err := CopyFile(filePath, binaryFilePath); err != nil {
-		return fmt.Errorf("failed to copy file: %s", err.Error())
-	}
-	binaryFilePath = filepath.Join(cacheDir, "__TMP__", "file")
-
-	return nil
-}
-
 func determineFileType(filePath string) (string, error) {
 	if rt.Config.DebugMode {
 		log.Printf("Determining file type for: %s\n", filePath)
@@ -142,16 +125,34 @@ func NormalizeMap(input map[any]any) map[string]any {
 	output := make(map[string]any)
 	for key, value := range input {
 		strKey := fmt.Sprintf("%v", key) // Convert key to string
-		switch v := value.(type) {
-		case map[any]any: // Recursively normalize nested maps
-			output[strKey] = NormalizeMap(v)
-		default:
-			output[strKey] = v
-		}
+		output[strKey] = NormalizeValue(value)
 	}
 	return output
 }
 
+// NormalizeValue recursively converts YAML maps inside value, including the ones
+// nested in lists, to map[string]any so that the result can be marshaled to JSON.
+func NormalizeValue(value any) any {
+	switch v := value.(type) {
+	case map[any]any:
+		return NormalizeMap(v)
+	case map[string]any:
+		output := make(map[string]any, len(v))
+		for key, item := range v {
+			output[key] = NormalizeValue(item)
+		}
+		return output
+	case []any:
+		output := make([]any, len(v))
+		for i, item := range v {
+			output[i] = NormalizeValue(item)
+		}
+		return output
+	default:
+		return v
+	}
+}
+
 func Unzip(src, dest string) error {
 	if rt.Config.DebugMode {
 		log.Printf("Unzipping file: %s into: %s\n", src, dest)
@@ -235,19 +236,103 @@ func CopyFile(src, dst string) error {
 	return os.Chmod(dst, srcInfo.Mode())
 }
 
-func GetFullPath(cacheDir string, targetFileName string) string {
-	var targetPath string
-	filepath.Walk(cacheDir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
+// PrefixWriter prefixes every line written to it before passing it on, so the
+// output of targets running concurrently stays readable. Only complete lines
+// are written; Flush writes what is left of the last one.
+type PrefixWriter struct {
+	mu     sync.Mutex
+	w      io.Writer
+	prefix []byte
+	buf    []byte
+}
+
+func NewPrefixWriter(w io.Writer, prefix string) *PrefixWriter {
+	return &PrefixWriter{w: w, prefix: []byte(prefix)}
+}
+
+func (p *PrefixWriter) Write(data []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.buf = append(p.buf, data...)
+	for {
+		i := bytes.IndexByte(p.buf, '\n')
+		if i < 0 {
+			break
 		}
-		if info.Name() == targetFileName {
-			targetPath = path
-			return filepath.SkipDir
+		line := append(append([]byte{}, p.prefix...), p.buf[:i+1]...)
+		if _, err := p.w.Write(line); err != nil {
+			return 0, err
 		}
+		p.buf = p.buf[i+1:]
+	}
+	return len(data), nil
+}
+
+func (p *PrefixWriter) Flush() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.buf) == 0 {
 		return nil
-	})
-	return targetPath
+	}
+	line := append(append(append([]byte{}, p.prefix...), p.buf...), '\n')
+	p.buf = nil
+	_, err := p.w.Write(line)
+	return err
+}
+
+// ShellQuote renders argv as a single line that a POSIX shell would split back
+// into the same arguments. It is meant for display only.
+func ShellQuote(argv []string) string {
+	quoted := make([]string, len(argv))
+	for i, arg := range argv {
+		if arg != "" && strings.Trim(arg, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_./=:,@%+") == "" {
+			quoted[i] = arg
+			continue
+		}
+		quoted[i] = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+	}
+	return strings.Join(quoted, " ")
+}
+
+// ClosestMatch returns the candidate with the smallest edit distance to name, or
+// an empty string when none of them is close enough to be a likely typo.
+func ClosestMatch(name string, candidates []string) string {
+	best, bestDistance := "", -1
+	for _, candidate := range candidates {
+		distance := levenshtein(name, candidate)
+		if bestDistance == -1 || distance < bestDistance {
+			best, bestDistance = candidate, distance
+		}
+	}
+
+	if bestDistance == -1 || bestDistance > max(2, len(name)/3) {
+		return ""
+	}
+	return best
+}
+
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(rb)]
 }
 
 func RandStringRunes(n int) string {